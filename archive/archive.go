@@ -0,0 +1,61 @@
+// Package archive saves copies of web pages, so that the posts
+// people save on vore outlive the websites they came from. each
+// place a copy can go is an Archiver.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Archiver saves a copy of a web page somewhere.
+type Archiver interface {
+	// Name identifies the archiver, on the command line & in
+	// the db.
+	Name() string
+	// Archive saves a copy of the page at pageURL & returns a
+	// url that the copy can be read at.
+	Archive(ctx context.Context, pageURL string) (string, error)
+}
+
+// The names of the built in archivers.
+const (
+	NameWayback = "archive.org"
+	NameToday   = "archive.today"
+	NameLocal   = "local"
+)
+
+// New returns the archivers with the given names, in the same
+// order. local is the store used for NameLocal, & wayback the
+// archiver used for NameWayback.
+func New(names []string, local *Local, wayback *Wayback) ([]Archiver, error) {
+	var archivers []Archiver
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("archive: %s is listed twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case NameWayback:
+			archivers = append(archivers, wayback)
+		case NameToday:
+			archivers = append(archivers, &Today{})
+		case NameLocal:
+			archivers = append(archivers, local)
+		default:
+			return nil, fmt.Errorf("archive: unknown archiver %q (want %s, %s or %s)",
+				name, NameWayback, NameToday, NameLocal)
+		}
+	}
+	if len(archivers) == 0 {
+		return nil, fmt.Errorf("archive: no archivers given")
+	}
+	return archivers, nil
+}
@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	local := &Local{Dir: t.TempDir()}
+	wb := &Wayback{}
+	archivers, err := New([]string{"local", " archive.today", "archive.org"}, local, wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range archivers {
+		names = append(names, a.Name())
+	}
+	if got := strings.Join(names, ","); got != "local,archive.today,archive.org" {
+		t.Fatalf("expected the archivers in order, got %s", got)
+	}
+	if archivers[0] != local || archivers[2] != wb {
+		t.Fatal("expected the given local store & wayback client to be used")
+	}
+
+	for _, bad := range [][]string{{"archive.org", "nope"}, {"local", "local"}, {""}} {
+		if _, err := New(bad, local, wb); err == nil {
+			t.Errorf("expected New(%q) to fail", bad)
+		}
+	}
+}
+
+type fakeArchiver struct {
+	name string
+	err  error
+}
+
+func (f fakeArchiver) Name() string { return f.name }
+
+func (f fakeArchiver) Archive(_ context.Context, u string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return "https://" + f.name + "/" + u, nil
+}
+
+func TestToday(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("url") {
+		case "https://example.com/new":
+			http.Redirect(w, r, "https://archive.ph/wip/AbCd", http.StatusFound)
+		case "https://example.com/old":
+			w.Header().Set("Refresh", "0;url=https://archive.ph/EfGh")
+		default:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	today := &Today{SubmitURL: srv.URL + "/submit/"}
+	for page, want := range map[string]string{
+		"https://example.com/new": "https://archive.ph/AbCd",
+		"https://example.com/old": "https://archive.ph/EfGh",
+	} {
+		got, err := today.Archive(context.Background(), page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("archiving %s: expected %s, got %s", page, want, got)
+		}
+	}
+	if _, err := today.Archive(context.Background(), "https://example.com/busy"); err == nil {
+		t.Fatal("expected an error without a snapshot")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "hello")
+		default:
+			fmt.Fprint(w, "<p>hello</p>")
+		}
+	}))
+	defer srv.Close()
+
+	local := &Local{Dir: t.TempDir(), Client: srv.Client()}
+	u, err := local.Archive(context.Background(), srv.URL+"/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same content is the same snapshot
+	again, err := local.Archive(context.Background(), srv.URL+"/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != again || !strings.HasPrefix(u, "/archive/") {
+		t.Fatalf("expected one snapshot url, got %s & %s", u, again)
+	}
+	if body := readSnapshot(t, local, u); !strings.Contains(body, "<p>hello</p>") {
+		t.Fatalf("unexpected snapshot %q", body)
+	}
+
+	// anything but html is kept as is
+	u, err = local.Archive(context.Background(), srv.URL+"/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readSnapshot(t, local, u); body != "hello" {
+		t.Fatalf("unexpected snapshot %q", body)
+	}
+
+	if _, err := local.Archive(context.Background(), srv.URL+"/missing"); err == nil {
+		t.Fatal("expected a 404 to fail")
+	}
+	for _, id := range []string{"../../etc/passwd", strings.Repeat("0", 64), ""} {
+		if _, err := local.Open(id); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("Open(%q): expected ErrNoSnapshot, got %v", id, err)
+		}
+	}
+}
+
+func readSnapshot(t *testing.T, local *Local, u string) string {
+	t.Helper()
+	f, err := local.Open(strings.TrimPrefix(u, "/archive/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestSnapshotInlining(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blog/post":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><head>
+				<base href="/blog/">
+				<meta http-equiv="refresh" content="0;url=https://elsewhere.example">
+				<link rel="stylesheet" href="style.css">
+				<link rel="stylesheet" href="/gone.css">
+				<style>body { background: url('bg.png') }</style>
+				<script>alert("hi")</script>
+				</head><body>
+				<img src="cat.png" srcset="cat-2x.png 2x">
+				<img src="/gone.png">
+				<a href="other">other post</a> <a href="#top">top</a>
+				</body></html>`)
+		case "/blog/style.css":
+			w.Header().Set("Content-Type", "text/css")
+			fmt.Fprint(w, `@font-face { src: url("fonts/f.woff2") }`)
+		case "/blog/fonts/f.woff2":
+			w.Header().Set("Content-Type", "font/woff2")
+			fmt.Fprint(w, "font")
+		case "/blog/cat.png", "/blog/bg.png":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "png")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	local := &Local{Dir: t.TempDir(), WARC: true, Client: srv.Client()}
+	u, err := local.Archive(context.Background(), srv.URL+"/blog/post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readSnapshot(t, local, u)
+
+	png := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("png"))
+	font := "data:font/woff2;base64," + base64.StdEncoding.EncodeToString([]byte("font"))
+	for _, want := range []string{
+		`<img src="` + png + `"/>`,
+		`background: url("` + png + `")`,
+		`src: url("` + font + `")`,
+		// things that couldn't be inlined still point somewhere
+		`<img src="` + srv.URL + `/gone.png"/>`,
+		`<link rel="stylesheet" href="` + srv.URL + `/gone.css"/>`,
+		`<a href="` + srv.URL + `/blog/other">`,
+		`<a href="#top">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the snapshot:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"<script", "srcset", "<base", "refresh", "style.css"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("didn't expect %q in the snapshot:\n%s", unwanted, body)
+		}
+	}
+
+	f, err := local.OpenWARC(strings.TrimPrefix(u, "/archive/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	warc, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(warc), "WARC/1.1\r\nWARC-Type: warcinfo\r\n") {
+		t.Fatalf("expected a warc, got:\n%s", warc)
+	}
+	// the page, the stylesheet, its font, & two images
+	if n := strings.Count(string(warc), "WARC-Type: response\r\n"); n != 5 {
+		t.Errorf("expected 5 responses in the warc, got %d", n)
+	}
+	if !strings.Contains(string(warc), "WARC-Target-URI: "+srv.URL+"/blog/post\r\n") {
+		t.Error("expected the page in the warc")
+	}
+}
+
+func TestLocalRefusesPrivateAddresses(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+		fmt.Fprint(w, "secret")
+	}))
+	defer srv.Close()
+
+	// srv is on 127.0.0.1, like anything else on the box
+	local := &Local{Dir: t.TempDir()}
+	_, err := local.Archive(context.Background(), srv.URL+"/admin")
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected ErrPrivateAddress, got %v", err)
+	}
+	if hit {
+		t.Fatal("expected the request to never be made")
+	}
+
+	for address, refused := range map[string]bool{
+		"127.0.0.1:80":         true,
+		"[::1]:80":             true,
+		"169.254.169.254:80":   true,
+		"10.0.0.1:443":         true,
+		"192.168.1.1:80":       true,
+		"100.64.0.1:80":        true,
+		"0.0.0.0:80":           true,
+		"[::ffff:10.0.0.1]:80": true,
+		"[fe80::1]:80":         true,
+		"93.184.216.34:443":    false,
+		"[2606:4700::1]:443":   false,
+	} {
+		err := refusePrivate("tcp", address, nil)
+		if refused != (err != nil) {
+			t.Errorf("%s: expected refused=%v, got %v", address, refused, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned when a page, or something in it,
+// is on an address that the local archiver won't fetch from.
+var ErrPrivateAddress = errors.New("archive: refusing to fetch from a private address")
+
+// carrier-grade nat space, which IsPrivate doesn't cover
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicClient is what Local fetches with, unless it's given a
+// client. saved links come from feeds, which anyone can write, &
+// snapshots are served to anyone, so it only connects to the
+// public internet: not to localhost, the lan or a cloud metadata
+// service. the check is made on each address as it's dialed, so
+// redirects & dns that points somewhere private are caught too.
+var publicClient = newPublicClient()
+
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: refusePrivate,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would do the dialing, out of our sight
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: time.Minute, Transport: transport}
+}
+
+// refusePrivate is a net.Dialer Control func that refuses to
+// connect to anything but public addresses.
+func refusePrivate(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+	}
+	return nil
+}
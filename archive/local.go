@@ -0,0 +1,134 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// maxSnapshotSize is the biggest page that Local will keep.
+const maxSnapshotSize = 20 << 20
+
+// ErrNoSnapshot is returned by Local.Open for ids it doesn't have.
+var ErrNoSnapshot = errors.New("archive: no such snapshot")
+
+// Local keeps snapshots of pages on disk, with their images &
+// css inlined so they can be shown without the original site.
+// they're named after the hash of their contents, so saving the
+// same page twice costs nothing. the site serves them at
+// /archive/{id}.
+type Local struct {
+	Dir string
+	// WARC also keeps every response that went into a snapshot
+	// as a warc file, served at /archive/{id}.warc
+	WARC bool
+	// Client defaults to one that won't fetch from localhost or
+	// private networks. see publicClient.
+	Client *http.Client
+}
+
+func (l *Local) Name() string {
+	return NameLocal
+}
+
+func (l *Local) Archive(ctx context.Context, pageURL string) (string, error) {
+	client := l.Client
+	if client == nil {
+		client = publicClient
+	}
+	snap, err := takeSnapshot(ctx, client, pageURL)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(snap.body)
+	id := hex.EncodeToString(sum[:])
+	err = writeFile(l.path(id), snap.body)
+	if err != nil {
+		return "", err
+	}
+	if l.WARC {
+		var warc bytes.Buffer
+		err = writeWARC(&warc, pageURL, snap.responses)
+		if err != nil {
+			return "", err
+		}
+		err = writeFile(l.path(id)+".warc", warc.Bytes())
+		if err != nil {
+			return "", err
+		}
+	}
+	return "/archive/" + id, nil
+}
+
+// writeFile writes data to path, unless there's already a file
+// there. snapshots never change, so an existing one is the same.
+func writeFile(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a snapshot is
+	// never seen half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path spreads snapshots over directories named after the first
+// two characters of their id, to keep directories small.
+func (l *Local) path(id string) string {
+	return filepath.Join(l.Dir, id[:2], id)
+}
+
+// Open returns the snapshot with the given id.
+func (l *Local) Open(id string) (*os.File, error) {
+	return l.open(id, "")
+}
+
+// OpenWARC returns the warc of the snapshot with the given id.
+func (l *Local) OpenWARC(id string) (*os.File, error) {
+	return l.open(id, ".warc")
+}
+
+func (l *Local) open(id string, ext string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNoSnapshot
+	}
+	f, err := os.Open(l.path(id) + ext)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSnapshot
+	}
+	return f, err
+}
+
+// validID reports whether id looks like a snapshot id, which
+// keeps anything else (like ../) out of file paths.
+func validID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,6 @@
+package archive
+
+import "git.j3s.sh/vore/metrics"
+
+var attemptsTotal = metrics.NewCounter("vore_archive_attempts_total",
+	"Attempts to archive a saved item, by archiver & outcome.", "archiver", "outcome")
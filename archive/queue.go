@@ -0,0 +1,156 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"git.j3s.sh/vore/sqlite"
+)
+
+const (
+	// how many jobs are worked on at once
+	queueWorkers = 2
+	// how often the queue looks for due jobs, besides when it's
+	// woken up
+	queuePoll = 30 * time.Second
+	// how long one archiver gets to archive one page
+	jobTimeout = 5 * time.Minute
+	// a claimed job isn't handed out again for this long, in
+	// case vore dies while working on it
+	jobLease = jobTimeout + time.Minute
+	// failed jobs are retried after retryMin, doubling each
+	// time up to retryMax, until maxAttempts have been made
+	retryMin    = time.Minute
+	retryMax    = 12 * time.Hour
+	maxAttempts = 8
+)
+
+// Queue works through the archive jobs in the db, in the
+// background. jobs that fail are retried with backoff, so a save
+// outlives an archiver being slow, down or rate limiting us.
+type Queue struct {
+	db        *sqlite.DB
+	archivers map[string]Archiver
+	wake      chan struct{}
+	// now is time.Now, except in tests
+	now func() time.Time
+}
+
+func NewQueue(db *sqlite.DB, archivers []Archiver) *Queue {
+	q := &Queue{
+		db:        db,
+		archivers: make(map[string]Archiver),
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+	for _, a := range archivers {
+		q.archivers[a.Name()] = a
+	}
+	return q
+}
+
+// Wake tells the queue that there's a new job, so that it
+// doesn't wait for its next poll.
+func (q *Queue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run works through jobs until ctx is done. jobs that are under
+// way then are put back for next time.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range queueWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				for q.work(ctx) {
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.wake:
+				case <-time.After(queuePoll):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// work does the job that's been due longest, if there is one,
+// and reports whether there was.
+func (q *Queue) work(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	now := q.now()
+	job, err := q.db.ClaimArchiveJob(now, now.Add(jobLease))
+	if err != nil {
+		log.Printf("archive: could not claim a job: %s\n", err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+
+	a, ok := q.archivers[job.Archiver]
+	if !ok {
+		// it's been turned off since the job was queued
+		q.finish(job, "", fmt.Errorf("%s isn't turned on", job.Archiver), true)
+		return true
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	archiveURL, err := a.Archive(jobCtx, job.ItemURL)
+	cancel()
+	if ctx.Err() != nil {
+		// it didn't fail, so it doesn't count towards giving up
+		err = q.db.ReleaseArchiveJob(job.ID, now)
+		if err != nil {
+			log.Printf("archive: could not put job %d back: %s\n", job.ID, err)
+		}
+		return false
+	}
+	q.finish(job, archiveURL, err, job.Attempts >= maxAttempts)
+	return true
+}
+
+// finish records how a job went. failed jobs are retried unless
+// giveUp is set.
+func (q *Queue) finish(job *sqlite.ArchiveJob, archiveURL string, jobErr error, giveUp bool) {
+	var err error
+	switch {
+	case jobErr == nil:
+		attemptsTotal.Inc(job.Archiver, "ok")
+		err = q.db.FinishArchiveJob(job.ID, archiveURL)
+	case giveUp:
+		attemptsTotal.Inc(job.Archiver, "error")
+		log.Printf("archive: %s gave up on %s after %d attempts: %s\n", job.Archiver, job.ItemURL, job.Attempts, jobErr)
+		err = q.db.FailArchiveJob(job.ID, jobErr.Error())
+	default:
+		attemptsTotal.Inc(job.Archiver, "error")
+		delay := retryDelay(job.Attempts)
+		log.Printf("archive: %s couldn't archive %s, retrying in %s: %s\n", job.Archiver, job.ItemURL, delay, jobErr)
+		err = q.db.RetryArchiveJob(job.ID, q.now().Add(delay), jobErr.Error())
+	}
+	if err != nil {
+		log.Printf("archive: could not record how job %d went: %s\n", job.ID, err)
+	}
+}
+
+// retryDelay is how long to wait after the given number of
+// failed attempts.
+func retryDelay(attempts int) time.Duration {
+	d := retryMin
+	for i := 1; i < attempts && d < retryMax; i++ {
+		d *= 2
+	}
+	return min(d, retryMax)
+}
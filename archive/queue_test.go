@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.j3s.sh/vore/sqlite"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		11: retryMax,
+		50: retryMax,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d): expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "vore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.QueueSavedItem("reader", sqlite.SavedItem{
+		ItemTitle: "a post",
+		ItemURL:   "https://example.com/post",
+	}, []string{"up", "down", "gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	q := NewQueue(db, []Archiver{
+		fakeArchiver{name: "up"},
+		fakeArchiver{name: "down", err: errors.New("oops")},
+	})
+	q.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// every job is tried once
+	for range 3 {
+		if !q.work(ctx) {
+			t.Fatal("expected a job to be due")
+		}
+	}
+	if q.work(ctx) {
+		t.Fatal("expected the failed job to wait before its retry")
+	}
+	saved, err := db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := saved[0]
+	if si.ArchiveStatus != sqlite.ArchivePending || len(si.Archives) != 1 || si.ArchiveURL != "https://up/https://example.com/post" {
+		t.Fatalf("expected one copy & a retry to be pending, got %+v", si)
+	}
+
+	// then the failing one is retried until it runs out of attempts
+	for attempt := 2; attempt <= maxAttempts; attempt++ {
+		now = now.Add(retryMax)
+		if !q.work(ctx) {
+			t.Fatalf("expected attempt %d to be due", attempt)
+		}
+	}
+	now = now.Add(retryMax)
+	if q.work(ctx) {
+		t.Fatal("expected the queue to have given up")
+	}
+	saved, err = db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si := saved[0]; si.ArchiveStatus != sqlite.ArchiveDone || si.ArchiveError == "" {
+		t.Errorf("expected the save to be done despite the failure, got %+v", si)
+	}
+}
+
+// shutdownArchiver stops vore part way through archiving.
+type shutdownArchiver struct {
+	stop context.CancelFunc
+}
+
+func (a shutdownArchiver) Name() string { return "slow" }
+
+func (a shutdownArchiver) Archive(ctx context.Context, _ string) (string, error) {
+	a.stop()
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestQueueInterrupted(t *testing.T) {
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "vore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.QueueSavedItem("reader", sqlite.SavedItem{
+		ItemTitle: "a post",
+		ItemURL:   "https://example.com/post",
+	}, []string{"slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart over & over, far more often than jobs get attempts
+	for range maxAttempts + 2 {
+		ctx, cancel := context.WithCancel(context.Background())
+		q := NewQueue(db, []Archiver{shutdownArchiver{stop: cancel}})
+		if q.work(ctx) {
+			t.Fatal("expected the queue to stop along with vore")
+		}
+	}
+
+	job, err := db.ClaimArchiveJob(time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.Attempts != 1 {
+		t.Fatalf("expected interruptions not to count as attempts, got %+v", job)
+	}
+}
@@ -0,0 +1,296 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// limits on what goes into a snapshot. past them, resources are
+// linked to rather than inlined.
+const (
+	maxResourceSize  = 5 << 20
+	maxResourceCount = 200
+)
+
+// snapshot is a page with its images & css inlined, so that it
+// can be shown without reaching out to the original site.
+type snapshot struct {
+	client *http.Client
+	// body is the page as it will be stored
+	body []byte
+	// responses are every http response that went into the
+	// snapshot, for writing out as warc
+	responses []capture
+	// budget is how many more bytes of resources can be inlined
+	budget int64
+}
+
+// capture is an http response, as it came over the wire.
+type capture struct {
+	url  string
+	date time.Time
+	raw  []byte
+}
+
+// takeSnapshot fetches pageURL & everything it needs to be shown.
+// pages that aren't html are stored as they are.
+func takeSnapshot(ctx context.Context, client *http.Client, pageURL string) (*snapshot, error) {
+	s := &snapshot{client: client, budget: maxSnapshotSize}
+	body, contentType, base, err := s.get(ctx, pageURL, maxSnapshotSize)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/html" {
+		s.body = body
+		return s, nil
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.inline(ctx, doc, base)
+
+	var buf bytes.Buffer
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return nil, err
+	}
+	s.body = buf.Bytes()
+	return s, nil
+}
+
+// get fetches u, noting the response for the warc. limit bounds
+// the size of the body.
+func (s *snapshot) get(ctx context.Context, u string, limit int64) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req.Header.Set("User-Agent", "vore: archiver")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", nil, fmt.Errorf("local: non-2xx status from %s: %s", u, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, "", nil, fmt.Errorf("local: %s is bigger than %d bytes", u, limit)
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "%s %s\r\n", resp.Proto, resp.Status)
+	resp.Header.Write(&raw)
+	raw.WriteString("\r\n")
+	raw.Write(body)
+	s.responses = append(s.responses, capture{
+		url:  resp.Request.URL.String(),
+		date: time.Now().UTC(),
+		raw:  raw.Bytes(),
+	})
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return body, contentType, resp.Request.URL, nil
+}
+
+// dataURL fetches u & returns it as a data: url. if it can't, or
+// the snapshot is full, it returns u.
+func (s *snapshot) dataURL(ctx context.Context, u string) string {
+	if strings.HasPrefix(u, "data:") || len(s.responses) >= maxResourceCount || s.budget <= 0 {
+		return u
+	}
+	body, contentType, _, err := s.get(ctx, u, min(maxResourceSize, s.budget))
+	if err != nil {
+		return u
+	}
+	s.budget -= int64(len(body))
+	// parameters like charset have no place in a data: url
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(body)
+}
+
+// inline walks doc, swapping images & stylesheets for inlined
+// copies, and making links absolute so they still go to the
+// original site. scripts are dropped: snapshots are served in
+// a sandbox that wouldn't run them anyway.
+func (s *snapshot) inline(ctx context.Context, doc *html.Node, base *url.URL) {
+	// a <base> changes what every relative url is relative to
+	if b := find(doc, "base"); b != nil {
+		if href, ok := attr(b, "href"); ok {
+			if u, err := base.Parse(href); err == nil {
+				base = u
+			}
+		}
+		b.Parent.RemoveChild(b)
+	}
+	abs := func(ref string) string {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return ref
+		}
+		return u.String()
+	}
+
+	var remove []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "script", "noscript":
+				remove = append(remove, n)
+				return
+			case "meta":
+				// a snapshot shouldn't wander off elsewhere
+				if equiv, _ := attr(n, "http-equiv"); strings.EqualFold(equiv, "refresh") {
+					remove = append(remove, n)
+					return
+				}
+			case "img":
+				// srcset would have the browser fetch from the
+				// original site
+				delAttr(n, "srcset")
+				delAttr(n, "loading")
+				if src, ok := attr(n, "src"); ok {
+					setAttr(n, "src", s.dataURL(ctx, abs(src)))
+				}
+			case "source":
+				// <picture> falls back to its <img>
+				if n.Parent != nil && n.Parent.Data == "picture" {
+					remove = append(remove, n)
+					return
+				}
+			case "link":
+				rel, _ := attr(n, "rel")
+				href, ok := attr(n, "href")
+				if !ok {
+					break
+				}
+				if hasRel(rel, "stylesheet") {
+					if css, ok := s.stylesheet(ctx, abs(href)); ok {
+						style := &html.Node{Type: html.ElementNode, Data: "style"}
+						style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+						n.Parent.InsertBefore(style, n)
+						remove = append(remove, n)
+						return
+					}
+				}
+				setAttr(n, "href", abs(href))
+			case "style":
+				if c := n.FirstChild; c != nil && c.Type == html.TextNode {
+					c.Data = s.inlineCSS(ctx, c.Data, base)
+				}
+			case "a", "area":
+				if href, ok := attr(n, "href"); ok && !strings.HasPrefix(href, "#") {
+					setAttr(n, "href", abs(href))
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+}
+
+// stylesheet fetches the css at u, with its own urls inlined.
+func (s *snapshot) stylesheet(ctx context.Context, u string) (string, bool) {
+	if len(s.responses) >= maxResourceCount || s.budget <= 0 {
+		return "", false
+	}
+	body, _, final, err := s.get(ctx, u, min(maxResourceSize, s.budget))
+	if err != nil {
+		return "", false
+	}
+	s.budget -= int64(len(body))
+	return s.inlineCSS(ctx, string(body), final), true
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+// inlineCSS swaps the url()s in css (fonts, background images,
+// & so on) for data: urls. they're relative to base.
+func (s *snapshot) inlineCSS(ctx context.Context, css string, base *url.URL) string {
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		ref := cssURL.FindStringSubmatch(m)[2]
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return m
+		}
+		return `url("` + s.dataURL(ctx, u.String()) + `")`
+	})
+}
+
+func find(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := find(c, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func attr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func setAttr(n *html.Node, key string, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func delAttr(n *html.Node, key string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+			return
+		}
+	}
+}
+
+func hasRel(rel string, want string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Today archives pages on archive.today (aka archive.ph, & a
+// handful of other mirrors).
+type Today struct {
+	// SubmitURL is where pages are submitted. it defaults to
+	// https://archive.today/submit/.
+	SubmitURL string
+	// Client defaults to one that doesn't follow redirects,
+	// since the redirect is the answer.
+	Client *http.Client
+}
+
+func (t *Today) Name() string {
+	return NameToday
+}
+
+func (t *Today) Archive(ctx context.Context, pageURL string) (string, error) {
+	submitURL := t.SubmitURL
+	if submitURL == "" {
+		submitURL = "https://archive.today/submit/"
+	}
+	client := t.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: 2 * time.Minute,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	form := url.Values{"url": {pageURL}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, submitURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "vore: archiver")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// a new capture redirects to the snapshot, & a page that's
+	// already been captured recently refreshes to it instead
+	snapshot := resp.Header.Get("Location")
+	if snapshot == "" {
+		_, after, ok := strings.Cut(resp.Header.Get("Refresh"), "url=")
+		if ok {
+			snapshot = strings.TrimSpace(after)
+		}
+	}
+	if snapshot == "" {
+		return "", fmt.Errorf("archive.today: no snapshot in response: %s", resp.Status)
+	}
+
+	// captures still in progress live under /wip/ until they're
+	// done, then move to the same path without it
+	return strings.Replace(snapshot, "/wip/", "/", 1), nil
+}
@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+// writeWARC writes responses out as a WARC 1.1 file, the format
+// that web archives (archive.org among them) use to swap
+// captures: a warcinfo record, then one response record for each
+// http response.
+func writeWARC(w io.Writer, pageURL string, responses []capture) error {
+	info := fmt.Sprintf("software: vore\r\nformat: WARC File Format 1.1\r\nisPartOf: %s\r\n", pageURL)
+	err := writeRecord(w, "warcinfo", "", time.Now().UTC(), "application/warc-fields", []byte(info))
+	if err != nil {
+		return err
+	}
+	for _, c := range responses {
+		err = writeRecord(w, "response", c.url, c.date, "application/http;msgtype=response", c.raw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, typ string, target string, date time.Time, contentType string, block []byte) error {
+	id, err := uuid()
+	if err != nil {
+		return err
+	}
+	header := "WARC/1.1\r\n" +
+		"WARC-Type: " + typ + "\r\n" +
+		"WARC-Record-ID: <urn:uuid:" + id + ">\r\n" +
+		"WARC-Date: " + date.Format(time.RFC3339) + "\r\n"
+	if target != "" {
+		header += "WARC-Target-URI: " + target + "\r\n"
+	}
+	header += "Content-Type: " + contentType + "\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n", len(block)) +
+		"\r\n"
+
+	_, err = io.WriteString(w, header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(block)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// uuid returns a random (version 4) uuid.
+func uuid() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,21 @@
+package archive
+
+import (
+	"context"
+
+	"git.j3s.sh/vore/wayback"
+)
+
+// Wayback archives pages on the internet archive's wayback
+// machine.
+type Wayback struct {
+	Client wayback.Client
+}
+
+func (w *Wayback) Name() string {
+	return NameWayback
+}
+
+func (w *Wayback) Archive(ctx context.Context, pageURL string) (string, error) {
+	return w.Client.Archive(ctx, pageURL)
+}
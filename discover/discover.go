@@ -0,0 +1,170 @@
+// Package discover finds the feeds behind a website: the ones
+// it advertises with <link rel="alternate"> tags, the ones that
+// well-known sites publish at predictable urls, and the ones
+// sitting at common paths.
+package discover
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxBodySize is how much of a page or feed is read.
+const maxBodySize = 10 << 20
+
+// ErrNotHTML is returned by Fetch for pages that aren't html,
+// which can't advertise feeds.
+var ErrNotHTML = errors.New("not an html page")
+
+// response is the useful bits of a GET.
+type response struct {
+	body        []byte
+	contentType string
+	// url is where any redirects ended up
+	url *url.URL
+}
+
+func get(ctx context.Context, client *http.Client, u string) (*response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "vore: feed finder")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("non-2xx status from site: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return &response{
+		body:        body,
+		contentType: resp.Header.Get("Content-Type"),
+		url:         resp.Request.URL,
+	}, nil
+}
+
+// Fetch gets the page at pageURL and returns the feeds it
+// advertises, as absolute urls.
+func Fetch(ctx context.Context, client *http.Client, pageURL string) ([]string, error) {
+	resp, err := get(ctx, client, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if !IsHTML(resp.contentType) {
+		return nil, ErrNotHTML
+	}
+	p, err := parsePage(bytes.NewReader(resp.body), resp.url)
+	if err != nil {
+		return nil, err
+	}
+	return p.feeds, nil
+}
+
+// Feeds parses the html in r & returns the feeds it advertises,
+// in the order they appear, made absolute against base.
+func Feeds(r io.Reader, base *url.URL) ([]string, error) {
+	p, err := parsePage(r, base)
+	if err != nil {
+		return nil, err
+	}
+	return p.feeds, nil
+}
+
+// page is what discovery cares about in an html page.
+type page struct {
+	feeds []string
+	// canonical is the page's <link rel="canonical">, if any.
+	// sites like youtube put the stable url of a channel here,
+	// which the rules can make a feed out of.
+	canonical *url.URL
+}
+
+func parsePage(r io.Reader, base *url.URL) (*page, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &page{}
+	seen := make(map[string]bool)
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "link" {
+			var rel, typ, href string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "rel":
+					rel = attr.Val
+				case "type":
+					typ = attr.Val
+				case "href":
+					href = attr.Val
+				}
+			}
+
+			// make href absolute if necessary
+			u, err := base.Parse(href)
+			switch {
+			case href == "" || err != nil:
+			case hasRel(rel, "alternate") && IsFeedType(typ):
+				if !seen[u.String()] {
+					seen[u.String()] = true
+					p.feeds = append(p.feeds, u.String())
+				}
+			case hasRel(rel, "canonical") && p.canonical == nil:
+				p.canonical = u
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+	return p, nil
+}
+
+// hasRel reports whether a rel attribute, which is a space
+// separated list, includes want.
+func hasRel(rel string, want string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFeedType reports whether a <link> type attribute
+// advertises a feed format that vore can parse.
+func IsFeedType(typ string) bool {
+	switch strings.ToLower(strings.TrimSpace(typ)) {
+	case "application/rss+xml", "application/atom+xml", "application/feed+json":
+		return true
+	}
+	return false
+}
+
+// IsHTML reports whether a Content-Type header is for html.
+func IsHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
@@ -0,0 +1,129 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testPage = `<!doctype html>
+<html><head>
+<link rel="stylesheet" href="/style.css">
+<link rel="alternate" type="application/rss+xml" href="/rss.xml">
+<link rel="alternate nofollow" type="Application/Atom+XML" href="https://cdn.example.com/atom.xml">
+<link rel="alternate" type="application/rss+xml" href="/rss.xml">
+<link rel="alternate" type="text/html" hreflang="fr" href="/fr/">
+<link rel="alternate" type="application/feed+json" href="feed.json">
+</head><body></body></html>`
+
+func TestFeeds(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	feeds, err := Feeds(strings.NewReader(testPage), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://example.com/rss.xml",
+		"https://cdn.example.com/atom.xml",
+		"https://example.com/blog/feed.json",
+	}
+	if !slices.Equal(feeds, want) {
+		t.Fatalf("expected %q, got %q", want, feeds)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/blog/", http.StatusFound)
+		case "/blog/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<link rel="alternate" type="application/rss+xml" href="rss.xml">`)
+		case "/blog/rss.xml":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, `<rss></rss>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// relative links resolve against where the redirect ended up
+	feeds, err := Fetch(context.Background(), srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{srv.URL + "/blog/rss.xml"}; !slices.Equal(feeds, want) {
+		t.Fatalf("expected %q, got %q", want, feeds)
+	}
+
+	_, err = Fetch(context.Background(), srv.Client(), srv.URL+"/blog/rss.xml")
+	if err != ErrNotHTML {
+		t.Fatalf("expected ErrNotHTML, got %v", err)
+	}
+	_, err = Fetch(context.Background(), srv.Client(), srv.URL+"/missing")
+	if err == nil {
+		t.Fatal("expected a 404 to fail")
+	}
+}
+
+func TestFind(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/@someone":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<link rel="alternate" type="application/atom+xml" href="/posts.atom">
+				<link rel="alternate" type="application/rss+xml" href="/broken.xml">`)
+		case "/posts.atom":
+			fmt.Fprint(w, `<feed xmlns="http://www.w3.org/2005/Atom"><title>posts</title>
+				<entry><id>1</id><title>old</title><updated>2020-01-01T00:00:00Z</updated></entry>
+				<entry><id>2</id><title>new</title><updated>2024-06-01T00:00:00Z</updated></entry>
+				</feed>`)
+		case "/@someone.rss", "/index.xml":
+			fmt.Fprint(w, `<rss version="2.0"><channel><title>rss</title></channel></rss>`)
+		case "/broken.xml":
+			fmt.Fprint(w, `this isn't a feed`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	results, err := Find(context.Background(), srv.Client(), srv.URL+"/@someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, r := range results {
+		urls = append(urls, r.URL)
+	}
+	want := []string{srv.URL + "/posts.atom", srv.URL + "/@someone.rss", srv.URL + "/index.xml"}
+	if !slices.Equal(urls, want) {
+		t.Fatalf("expected %q, got %q", want, urls)
+	}
+
+	posts := results[0]
+	if posts.Title != "posts" || posts.Items != 2 || posts.LastPost.Year() != 2024 || posts.Source != "advertised by the page" {
+		t.Fatalf("unexpected result %+v", posts)
+	}
+
+	// a feed url finds itself
+	results, err = Find(context.Background(), srv.Client(), srv.URL+"/posts.atom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].URL != srv.URL+"/posts.atom" || results[0].Source != "the url itself" {
+		t.Fatalf("expected the feed to find itself, got %+v", results)
+	}
+
+	_, err = Find(context.Background(), srv.Client(), "http://127.0.0.1:1/")
+	if err == nil {
+		t.Fatal("expected an error when there's nothing to find")
+	}
+}
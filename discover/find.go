@@ -0,0 +1,118 @@
+package discover
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"git.j3s.sh/vore/rss"
+)
+
+// probeConcurrency is how many candidate feeds Find fetches at
+// once.
+const probeConcurrency = 6
+
+// Result is a feed that Find fetched & parsed.
+type Result struct {
+	URL   string
+	Title string
+	Items int
+	// LastPost is the date of the newest item, if there are any
+	LastPost time.Time
+	// Source is how the feed was found
+	Source string
+}
+
+// Find looks everywhere it knows for feeds behind pageURL: the
+// page itself, the feeds it advertises, the rules for well-known
+// sites & the common paths. every candidate is fetched, and only
+// the ones that turn out to be feeds are returned, in that order.
+// ctx bounds the whole search. an error is only returned if
+// nothing was found & the page itself couldn't be fetched.
+func Find(ctx context.Context, client *http.Client, pageURL string) ([]Result, error) {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	var candidates []Result
+	seen := map[string]bool{pageURL: true}
+	add := func(source string, urls ...string) {
+		for _, c := range urls {
+			if !seen[c] {
+				seen[c] = true
+				candidates = append(candidates, Result{URL: c, Source: source})
+			}
+		}
+	}
+
+	resp, pageErr := get(ctx, client, pageURL)
+	if pageErr == nil {
+		if IsHTML(resp.contentType) {
+			p, err := parsePage(bytes.NewReader(resp.body), resp.url)
+			if err == nil {
+				add("advertised by the page", p.feeds...)
+				if p.canonical != nil {
+					add("known site", Rules(p.canonical)...)
+				}
+			}
+		} else if r, err := parseFeed(pageURL, resp.body); err == nil {
+			r.Source = "the url itself"
+			results = append(results, r)
+		}
+	}
+	add("known site", Rules(u)...)
+	add("common path", commonPathURLs(u)...)
+
+	found := make([]*Result, len(candidates))
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, c := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			resp, err := get(ctx, client, c.URL)
+			if err != nil {
+				return
+			}
+			r, err := parseFeed(c.URL, resp.body)
+			if err != nil {
+				return
+			}
+			r.Source = c.Source
+			found[i] = &r
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range found {
+		if r != nil {
+			results = append(results, *r)
+		}
+	}
+	if len(results) == 0 && pageErr != nil {
+		return nil, pageErr
+	}
+	return results, nil
+}
+
+func parseFeed(u string, body []byte) (Result, error) {
+	feed, err := rss.Parse(body)
+	if err != nil {
+		return Result{}, err
+	}
+	r := Result{URL: u, Title: feed.Title, Items: len(feed.Items)}
+	for _, item := range feed.Items {
+		if item.Date.After(r.LastPost) {
+			r.LastPost = item.Date
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,60 @@
+package discover
+
+import (
+	"net/url"
+	"strings"
+)
+
+// CommonPaths are where sites tend to keep a feed without
+// advertising it.
+var CommonPaths = []string{"/feed", "/rss.xml", "/atom.xml", "/index.xml"}
+
+// Rules returns the feeds that well-known sites publish for the
+// page at u, worked out from the url alone. they're guesses, so
+// they need fetching to see if they're real.
+func Rules(u *url.URL) []string {
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch host {
+	case "youtube.com", "m.youtube.com":
+		// handles (/@name) don't have a feed url, but their pages
+		// link to the canonical /channel/ url, which does
+		const feeds = "https://www.youtube.com/feeds/videos.xml"
+		switch {
+		case len(segs) >= 2 && segs[0] == "channel":
+			return []string{feeds + "?channel_id=" + url.QueryEscape(segs[1])}
+		case len(segs) >= 2 && segs[0] == "user":
+			return []string{feeds + "?user=" + url.QueryEscape(segs[1])}
+		case u.Query().Get("list") != "":
+			return []string{feeds + "?playlist_id=" + url.QueryEscape(u.Query().Get("list"))}
+		}
+		return nil
+	case "github.com":
+		if len(segs) >= 2 && segs[0] != "" && segs[1] != "" {
+			repo := "https://github.com/" + segs[0] + "/" + strings.TrimSuffix(segs[1], ".git")
+			return []string{repo + "/releases.atom", repo + "/commits.atom"}
+		}
+		return nil
+	case "reddit.com", "old.reddit.com", "new.reddit.com":
+		if len(segs) >= 2 && segs[0] == "r" && segs[1] != "" {
+			return []string{"https://www.reddit.com/r/" + segs[1] + "/.rss"}
+		}
+		return nil
+	}
+
+	// mastodon profiles (& those of anything that copies it)
+	if len(segs) == 1 && len(segs[0]) > 1 && strings.HasPrefix(segs[0], "@") {
+		return []string{u.Scheme + "://" + u.Host + "/" + segs[0] + ".rss"}
+	}
+	return nil
+}
+
+// commonPathURLs returns CommonPaths on u's host.
+func commonPathURLs(u *url.URL) []string {
+	var urls []string
+	for _, p := range CommonPaths {
+		urls = append(urls, u.Scheme+"://"+u.Host+p)
+	}
+	return urls
+}
@@ -0,0 +1,53 @@
+package discover
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"https://www.youtube.com/channel/UCuAXFkgsw1L7xaCfnd5JJOw", []string{
+			"https://www.youtube.com/feeds/videos.xml?channel_id=UCuAXFkgsw1L7xaCfnd5JJOw",
+		}},
+		{"https://youtube.com/user/RickAstleyVEVO/videos", []string{
+			"https://www.youtube.com/feeds/videos.xml?user=RickAstleyVEVO",
+		}},
+		{"https://www.youtube.com/playlist?list=PL123", []string{
+			"https://www.youtube.com/feeds/videos.xml?playlist_id=PL123",
+		}},
+		// handles are found through the page's canonical link
+		{"https://www.youtube.com/@RickAstleyYT", nil},
+		{"https://github.com/golang/go.git", []string{
+			"https://github.com/golang/go/releases.atom",
+			"https://github.com/golang/go/commits.atom",
+		}},
+		{"https://github.com/golang/go/issues/1", []string{
+			"https://github.com/golang/go/releases.atom",
+			"https://github.com/golang/go/commits.atom",
+		}},
+		{"https://github.com/golang", nil},
+		{"https://old.reddit.com/r/golang/top/", []string{
+			"https://www.reddit.com/r/golang/.rss",
+		}},
+		{"https://reddit.com/user/spez", nil},
+		{"https://mastodon.social/@Gargron", []string{
+			"https://mastodon.social/@Gargron.rss",
+		}},
+		{"https://mastodon.social/@Gargron/123", nil},
+		{"https://example.com/", nil},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Rules(u); !slices.Equal(got, test.want) {
+			t.Errorf("Rules(%s) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"git.j3s.sh/vore/metrics"
 	"golang.org/x/net/html"
 )
 
@@ -23,12 +24,15 @@ type FaviconCache struct {
 }
 
 type FaviconFetcher struct {
+	// every fetch is abandoned once ctx is done
+	ctx    context.Context
 	cache  *FaviconCache
 	client *http.Client
 }
 
-func NewFaviconFetcher() *FaviconFetcher {
-	return &FaviconFetcher{
+func NewFaviconFetcher(ctx context.Context) *FaviconFetcher {
+	f := &FaviconFetcher{
+		ctx: ctx,
 		cache: &FaviconCache{
 			cache: make(map[string]string),
 		},
@@ -36,6 +40,11 @@ func NewFaviconFetcher() *FaviconFetcher {
 			Timeout: 10 * time.Second,
 		},
 	}
+	metrics.NewGaugeFunc("vore_favicon_cache_entries",
+		"Domains with a cached favicon.", func() float64 {
+			return float64(f.CacheSize())
+		})
+	return f
 }
 
 func (f *FaviconFetcher) GetFaviconDataURL(domain string) string {
@@ -45,6 +54,14 @@ func (f *FaviconFetcher) GetFaviconDataURL(domain string) string {
 	return f.cache.cache[domain]
 }
 
+// CacheSize returns how many domains have a cached favicon.
+func (f *FaviconFetcher) CacheSize() int {
+	f.cache.mutex.RLock()
+	defer f.cache.mutex.RUnlock()
+
+	return len(f.cache.cache)
+}
+
 func (f *FaviconFetcher) FetchFaviconsForDomains(feedURLs []string) {
 	domains := f.extractUniqueDomains(feedURLs)
 
@@ -65,11 +82,18 @@ func (f *FaviconFetcher) FetchFaviconsForDomains(feedURLs []string) {
 	}
 
 	for _, domain := range domains {
+		if f.ctx.Err() != nil {
+			break
+		}
 		domainChan <- domain
 	}
 	close(domainChan)
 
 	wg.Wait()
+	if f.ctx.Err() != nil {
+		log.Printf("favicon: stopped fetching favicons early: %s", f.ctx.Err())
+		return
+	}
 
 	log.Printf("favicon: finished fetching favicons, cached %d successful results", len(f.cache.cache))
 }
@@ -122,13 +146,17 @@ func (f *FaviconFetcher) fetchFaviconForDomain(domain string) {
 		}
 	}
 
+	if f.ctx.Err() != nil {
+		// we're shutting down, not out of luck
+		return
+	}
 	log.Printf("favicon: no favicon found for domain %s", domain)
 }
 
 // fetchFaviconDataURL fetches a favicon from the given URL and converts it to a data URL
 // Returns empty string if the favicon could not be fetched or converted
 func (f *FaviconFetcher) fetchFaviconDataURL(faviconURL string) string {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(f.ctx, 10*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, faviconURL, nil)
@@ -185,7 +213,7 @@ func (f *FaviconFetcher) fetchFaviconDataURL(faviconURL string) string {
 
 // discoverFaviconFromHTML fetches the HTML page and parses it to find favicon link tags
 func (f *FaviconFetcher) discoverFaviconFromHTML(baseURL string) []string {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(f.ctx, 10*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
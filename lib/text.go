@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PlainText returns the text of an html fragment, like a feed
+// item's summary, with its tags dropped & whitespace collapsed.
+func PlainText(fragment string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(fragment))
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+			case "p", "br", "div", "li":
+				b.WriteString(" ")
+			}
+		}
+	}
+}
@@ -1,36 +1,113 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.j3s.sh/vore/metrics"
 )
 
 func main() {
-	s := New()
-
-	http.HandleFunc("GET /{$}", s.indexHandler)
-	http.HandleFunc("GET /{username}", s.userHandler)
-	http.HandleFunc("GET /archive", s.userSavesHandler)
-	http.HandleFunc("GET /static/{file}", s.staticHandler)
-	http.HandleFunc("GET /finger", s.fingerHandler)
-	http.HandleFunc("POST /finger", s.fingerHandler)
-	http.HandleFunc("GET /changelog", s.changelogHandler)
-	http.HandleFunc("GET /feeds", s.settingsHandler)
-	http.HandleFunc("POST /feeds/submit", s.settingsSubmitHandler)
-	http.HandleFunc("GET /login", s.loginHandler)
-	http.HandleFunc("POST /login", s.loginHandler)
-	http.HandleFunc("GET /logout", s.logoutHandler)
-	http.HandleFunc("POST /logout", s.logoutHandler)
-	http.HandleFunc("POST /register", s.registerHandler)
-	http.HandleFunc("GET /save/{url}", s.saveHandler)
-	http.HandleFunc("GET /read/{url}", s.readHandler)
-	http.HandleFunc("GET /feeds/{url}", s.feedDetailsHandler)
+	var cfg Config
+	flag.IntVar(&cfg.Reaper.HostConcurrency, "host-concurrency", 2,
+		"most feed fetches in flight to a single host at once (0 for no limit)")
+	flag.DurationVar(&cfg.Reaper.HostInterval, "host-interval", time.Second,
+		"minimum time between feed fetches to a single host (0 for no limit)")
+	flag.DurationVar(&cfg.Reaper.RefreshFloor, "refresh-floor", 30*time.Minute,
+		"shortest refresh interval picked from how often a feed posts (0 for no limit)")
+	flag.DurationVar(&cfg.Reaper.RefreshCeiling, "refresh-ceiling", 24*time.Hour,
+		"longest refresh interval picked from how often a feed posts (0 for no limit)")
+	flag.DurationVar(&cfg.Reaper.FetchHistoryRetention, "fetch-history", 30*24*time.Hour,
+		"how long to keep each feed's fetch history (0 to keep it forever)")
+	flag.DurationVar(&cfg.Reaper.OrphanGrace, "orphan-grace", 7*24*time.Hour,
+		"how long a feed may go without subscribers before it's deleted (0 to keep it forever)")
+	archivers := flag.String("archivers", "archive.org,local",
+		"comma-separated archivers that saves go to, in order (archive.org, archive.today, local)")
+	flag.BoolVar(&cfg.SnapshotWARC, "snapshot-warc", false,
+		"also keep a warc of every local snapshot, served at /archive/{id}.warc")
+	flag.StringVar(&cfg.WaybackKeys, "wayback-keys", "",
+		"file holding archive.org api keys as access:secret, for captures with higher limits")
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"how long to wait for in-flight requests & fetches when stopping")
+	flag.Parse()
+	cfg.Archivers = strings.Split(*archivers, ",")
+
+	// SIGTERM is what docker & friends send to stop us
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := New(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// every route is instrumented for /metrics
+	handle := func(pattern string, h http.HandlerFunc) {
+		http.HandleFunc(pattern, metrics.InstrumentHandler(pattern, h))
+	}
+
+	handle("GET /{$}", s.indexHandler)
+	handle("GET /{username}", s.userHandler)
+	handle("GET /archive", s.userSavesHandler)
+	handle("GET /archive/{id}", s.snapshotHandler)
+	handle("POST /archive/{id}/delete", s.deleteSaveHandler)
+	handle("POST /archive/{id}/restore", s.restoreSaveHandler)
+	handle("POST /archive/{id}/note", s.saveNoteHandler)
+	handle("GET /static/{file}", s.staticHandler)
+	handle("GET /finger", s.fingerHandler)
+	handle("POST /finger", s.fingerHandler)
+	handle("GET /changelog", s.changelogHandler)
+	handle("GET /feeds", s.settingsHandler)
+	handle("POST /feeds/submit", s.settingsSubmitHandler)
+	handle("POST /feeds/confirm", s.settingsConfirmHandler)
+	handle("POST /feeds/subscribe", s.subscribeHandler)
+	handle("GET /login", s.loginHandler)
+	handle("POST /login", s.loginHandler)
+	handle("GET /logout", s.logoutHandler)
+	handle("POST /logout", s.logoutHandler)
+	handle("POST /register", s.registerHandler)
+	handle("POST /save/{url}", s.saveHandler)
+	handle("GET /read/{url}", s.readHandler)
+	handle("GET /feeds/{url}", s.feedDetailsHandler)
+	http.Handle("GET /metrics", metrics.Handler())
 
 	// backwards compatibility redirects
-	http.HandleFunc("GET /settings", s.settingsRedirectHandler)
-	http.HandleFunc("POST /settings/submit", s.settingsSubmitRedirectHandler)
-	http.HandleFunc("GET /saves", s.savesRedirectHandler)
+	handle("GET /settings", s.settingsRedirectHandler)
+	handle("POST /settings/submit", s.settingsSubmitRedirectHandler)
+	handle("GET /saves", s.savesRedirectHandler)
+
+	srv := &http.Server{Addr: ":5544"}
+	go func() {
+		log.Println("main: listening on http://localhost:5544")
+		err := srv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	// a second signal kills us straight away
+	stop()
+	log.Printf("main: shutting down, waiting up to %s for in-flight work\n", shutdownTimeout)
 
-	log.Println("main: listening on http://localhost:5544")
-	log.Fatal(http.ListenAndServe(":5544", nil))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("main: http server didn't shut down cleanly: %s\n", err)
+	}
+	err = s.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("main: couldn't close the database: %s\n", err)
+	}
+	log.Println("main: bye")
 }
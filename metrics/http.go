@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequests = NewCounter("vore_http_requests_total",
+		"HTTP requests served, by route & status code.", "method", "route", "code")
+	httpDuration = NewHistogram("vore_http_request_duration_seconds",
+		"How long HTTP requests took to serve, by route.", nil, "method", "route")
+)
+
+// InstrumentHandler records the latency & status of every request
+// served by h. pattern is the ServeMux pattern h is registered
+// under, e.g. "GET /feeds/{url}", and is used as the route label
+// so that urls with path values don't each get their own series.
+func InstrumentHandler(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	method, route, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, route = "", pattern
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+		httpRequests.Inc(method, route, strconv.Itoa(sw.status))
+		httpDuration.Observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
+// statusWriter remembers the status code a handler wrote.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController get at the real writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if !strings.Contains(body, l+"\n") {
+			t.Errorf("expected line %q in:\n%s", l, body)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_things_total", "Things.", "kind")
+	c.Inc("a")
+	c.Inc("a")
+	c.Add(2.5, `b"\`)
+
+	expectLines(t, scrape(t),
+		"# HELP test_things_total Things.",
+		"# TYPE test_things_total counter",
+		`test_things_total{kind="a"} 2`,
+		`test_things_total{kind="b\"\\"} 2.5`,
+	)
+	if v := c.Value("a"); v != 2 {
+		t.Fatalf("expected 2, got %v", v)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	n := 3.0
+	NewGaugeFunc("test_gauge", "A gauge.", func() float64 { return n })
+	n = 4
+	expectLines(t, scrape(t),
+		"# TYPE test_gauge gauge",
+		"test_gauge 4",
+	)
+
+	// re-registering replaces the old gauge
+	NewGaugeFunc("test_gauge", "A gauge.", func() float64 { return 5 })
+	body := scrape(t)
+	if strings.Count(body, "# TYPE test_gauge gauge") != 1 {
+		t.Fatalf("expected the gauge to be registered once:\n%s", body)
+	}
+	expectLines(t, body, "test_gauge 5")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "Durations.", []float64{1, 5}, "op")
+	h.Observe(0.5, "x")
+	h.Observe(1, "x")
+	h.Observe(3, "x")
+	h.Observe(10, "x")
+
+	expectLines(t, scrape(t),
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{op="x",le="1"} 2`,
+		`test_seconds_bucket{op="x",le="5"} 3`,
+		`test_seconds_bucket{op="x",le="+Inf"} 4`,
+		`test_seconds_sum{op="x"} 14.5`,
+		`test_seconds_count{op="x"} 4`,
+	)
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	h := InstrumentHandler("GET /things/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/things/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hi"))
+	})
+	for _, path := range []string{"/things/1", "/things/2", "/things/missing"} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	body := scrape(t)
+	expectLines(t, body,
+		`vore_http_requests_total{method="GET",route="/things/{id}",code="200"} 2`,
+		`vore_http_requests_total{method="GET",route="/things/{id}",code="404"} 1`,
+		`vore_http_request_duration_seconds_count{method="GET",route="/things/{id}"} 3`,
+	)
+}
@@ -0,0 +1,102 @@
+package reaper
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"git.j3s.sh/vore/rss"
+)
+
+// cadenceWindow is how many of a feed's most recent posts are
+// looked at when working out how often it posts.
+const cadenceWindow = 20
+
+// RefreshPlan is how long the reaper waits between refreshes
+// of a feed, and a human readable explanation of why.
+type RefreshPlan struct {
+	Interval time.Duration
+	Reason   string
+}
+
+// planRefresh works out how often f should be refreshed from how
+// often it has been posting, clamped between floor and ceiling
+// (either may be zero for no limit). a ttl set by the feed
+// itself always wins, & refreshes that fall in the feed's
+// skipHours or skipDays wait for them to pass (see rss.Feed.Skip).
+func planRefresh(f *rss.Feed, now time.Time, floor time.Duration, ceiling time.Duration) RefreshPlan {
+	plan := planInterval(f, now, floor, ceiling)
+	if len(f.SkipHours) > 0 || len(f.SkipDays) > 0 {
+		plan.Reason += ", outside the hours & days the feed asks to be skipped"
+	}
+	return plan
+}
+
+func planInterval(f *rss.Feed, now time.Time, floor time.Duration, ceiling time.Duration) RefreshPlan {
+	if f.TTL > 0 {
+		return RefreshPlan{
+			Interval: f.TTL,
+			Reason:   fmt.Sprintf("the feed asks to be refreshed every %s (ttl)", shortDuration(f.TTL)),
+		}
+	}
+
+	var dates []time.Time
+	for _, i := range f.Items {
+		if i.DateValid && !i.Date.After(now) {
+			dates = append(dates, i.Date)
+		}
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int {
+		return b.Compare(a)
+	})
+	if len(dates) > cadenceWindow {
+		dates = dates[:cadenceWindow]
+	}
+
+	var plan RefreshPlan
+	if len(dates) < 2 {
+		plan = RefreshPlan{
+			Interval: rss.DefaultRefreshInterval,
+			Reason:   fmt.Sprintf("too few dated posts to judge (%d), using the default", len(dates)),
+		}
+	} else {
+		gaps := make([]time.Duration, 0, len(dates)-1)
+		for i := 1; i < len(dates); i++ {
+			gaps = append(gaps, dates[i-1].Sub(dates[i]))
+		}
+		slices.Sort(gaps)
+		median := gaps[len(gaps)/2]
+		quiet := now.Sub(dates[0])
+
+		// check twice per typical gap between posts, but back off
+		// once the feed has been quiet for longer than usual
+		plan.Interval = max(median, quiet) / 2
+		plan.Reason = fmt.Sprintf("posts roughly every %s (median of the last %d gaps), last post %s ago",
+			shortDuration(median), len(gaps), shortDuration(quiet))
+	}
+
+	if floor > 0 && plan.Interval < floor {
+		plan.Interval = floor
+		plan.Reason += ", raised to the floor"
+	}
+	if ceiling > 0 && plan.Interval > ceiling {
+		plan.Interval = ceiling
+		plan.Reason += ", lowered to the ceiling"
+	}
+	return plan
+}
+
+// shortDuration formats d without the noise, e.g. "2h30m"
+// rather than "2h30m0s"
+func shortDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "under a minute"
+	}
+	s := strings.TrimSuffix(d.String(), "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package reaper
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.j3s.sh/vore/rss"
+)
+
+func TestPlanRefresh(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// posted every gap, most recent post at now-since
+	posts := func(n int, gap time.Duration, since time.Duration) []*rss.Item {
+		var items []*rss.Item
+		for i := range n {
+			items = append(items, &rss.Item{
+				Date:      now.Add(-since - time.Duration(i)*gap),
+				DateValid: true,
+			})
+		}
+		return items
+	}
+
+	tests := map[string]struct {
+		feed     *rss.Feed
+		floor    time.Duration
+		ceiling  time.Duration
+		interval time.Duration
+		reason   string
+	}{
+		"busy feed": {
+			feed:     &rss.Feed{Items: posts(10, 4*time.Hour, time.Hour)},
+			interval: 2 * time.Hour,
+			reason:   "posts roughly every 4h (median of the last 9 gaps), last post 1h ago",
+		},
+		"busy feed hits the floor": {
+			feed:     &rss.Feed{Items: posts(30, 10*time.Minute, 0)},
+			floor:    30 * time.Minute,
+			interval: 30 * time.Minute,
+			reason:   "posts roughly every 10m (median of the last 19 gaps), last post under a minute ago, raised to the floor",
+		},
+		"dormant feed hits the ceiling": {
+			feed:     &rss.Feed{Items: posts(5, 24*time.Hour, 90*24*time.Hour)},
+			ceiling:  24 * time.Hour,
+			interval: 24 * time.Hour,
+			reason:   "posts roughly every 24h (median of the last 4 gaps), last post 2160h ago, lowered to the ceiling",
+		},
+		"too few posts": {
+			feed:     &rss.Feed{Items: posts(1, 0, time.Hour)},
+			interval: rss.DefaultRefreshInterval,
+			reason:   "too few dated posts to judge (1), using the default",
+		},
+		"ttl wins": {
+			feed: &rss.Feed{
+				TTL:   3 * time.Hour,
+				Items: posts(10, 10*time.Minute, 0),
+			},
+			ceiling:  time.Hour,
+			interval: 3 * time.Hour,
+			reason:   "the feed asks to be refreshed every 3h (ttl)",
+		},
+	}
+
+	for name, test := range tests {
+		got := planRefresh(test.feed, now, test.floor, test.ceiling)
+		if got.Interval != test.interval {
+			t.Errorf("%s: got interval %s, want %s", name, got.Interval, test.interval)
+		}
+		if got.Reason != test.reason {
+			t.Errorf("%s: got reason %q, want %q", name, got.Reason, test.reason)
+		}
+	}
+}
+
+func TestPlanRefreshIgnoresFuturePosts(t *testing.T) {
+	now := time.Now()
+	f := &rss.Feed{Items: []*rss.Item{
+		{Date: now.Add(24 * time.Hour), DateValid: true},
+		{Date: now.Add(-time.Hour), DateValid: true},
+		{Date: now.Add(-3 * time.Hour), DateValid: true},
+		{Date: now.Add(-5 * time.Hour)},
+	}}
+	got := planRefresh(f, now, 0, 0)
+	if !strings.Contains(got.Reason, "median of the last 1 gaps") {
+		t.Errorf("expected only the 2 valid, past posts to count, got %q", got.Reason)
+	}
+}
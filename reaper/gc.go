@@ -0,0 +1,73 @@
+package reaper
+
+import (
+	"log"
+	"time"
+)
+
+// collectOrphans removes every feed that has gone without a
+// subscriber for longer than the configured grace period as of
+// now, from both the db & the reaper, so that nobody's polling
+// it forever.
+func (r *Reaper) collectOrphans(now time.Time) {
+	urls, err := r.db.ReapOrphanedFeeds(now, r.cfg.OrphanGrace)
+	if err != nil {
+		log.Printf("reaper: could not collect orphaned feeds: %s\n", err)
+		return
+	}
+	r.mu.Lock()
+	for _, url := range urls {
+		r.removeFeedLocked(url)
+	}
+	r.mu.Unlock()
+	for _, url := range urls {
+		r.sched.remove(url)
+		feedsReaped.Inc()
+		log.Printf("reaper: reaped %s, it's had no subscribers for over %s\n",
+			url, shortDuration(r.cfg.OrphanGrace))
+	}
+	r.refetchResubscribed(urls)
+}
+
+// refetchResubscribed fetches any of the just reaped urls that
+// have been subscribed to again. a subscription that lands after
+// a feed is deleted from the db, but before it's removed from the
+// reaper, sees the feed as present & leaves it be.
+func (r *Reaper) refetchResubscribed(urls []string) {
+	for _, url := range urls {
+		_, exists, err := r.db.GetFeedIDAndExists(url)
+		if err != nil {
+			log.Printf("reaper: could not check on reaped feed %s: %s\n", url, err)
+			continue
+		}
+		if !exists || r.HasFeed(url) {
+			continue
+		}
+		log.Printf("reaper: %s was subscribed to as it was reaped, fetching it again\n", url)
+		err = r.FetchContext(r.ctx, url)
+		if err != nil {
+			log.Printf("reaper: could not fetch %s again: %s\n", url, err)
+		}
+	}
+}
+
+// collectOrphansHourly runs collectOrphans every hour until
+// the reaper stops. it should only be started if there is a
+// grace period.
+func (r *Reaper) collectOrphansHourly() {
+	for {
+		r.collectOrphans(r.clock.Now())
+		if !r.sleep(time.Hour) {
+			return
+		}
+	}
+}
+
+// removeFeedLocked stops maintaining the feed at url. a refresh
+// of it that's already in flight is dropped when it finishes.
+// callers must hold r.mu, & unschedule the feed themselves.
+func (r *Reaper) removeFeedLocked(url string) {
+	delete(r.feeds, url)
+	delete(r.backoff, url)
+	delete(r.plans, url)
+}
@@ -0,0 +1,173 @@
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCollectOrphans(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>%s</title></channel></rss>`, req.URL.Path)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{OrphanGrace: time.Hour})
+	kept, orphan, resubscribed := srv.URL+"/kept", srv.URL+"/orphan", srv.URL+"/resubscribed"
+	for _, u := range []string{kept, orphan, resubscribed} {
+		err := r.Fetch(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BatchSubscribe("reader", []string{kept})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first pass only notices the orphans
+	r.collectOrphans(time.Now())
+	for _, u := range []string{kept, orphan, resubscribed} {
+		if !r.HasFeed(u) {
+			t.Fatalf("%s was reaped before the grace period was up", u)
+		}
+	}
+
+	err = db.BatchSubscribe("reader", []string{kept, resubscribed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.collectOrphans(time.Now().Add(2 * time.Hour))
+
+	if r.HasFeed(orphan) {
+		t.Fatal("expected the orphan to be reaped")
+	}
+	if _, ok := r.sched.dueAt(orphan); ok {
+		t.Fatal("expected the orphan to be unscheduled")
+	}
+	urls, err := db.GetAllFeedURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(urls, orphan) {
+		t.Fatal("expected the orphan to be deleted from the db")
+	}
+	for _, u := range []string{kept, resubscribed} {
+		if !r.HasFeed(u) || !slices.Contains(urls, u) {
+			t.Fatalf("%s has subscribers & should not have been reaped", u)
+		}
+	}
+}
+
+func TestUserFeedsSkipReapedFeeds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>%s</title></channel></rss>`, req.URL.Path)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{OrphanGrace: time.Hour})
+	kept, orphan := srv.URL+"/kept", srv.URL+"/orphan"
+	for _, u := range []string{kept, orphan} {
+		err := r.Fetch(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BatchSubscribe("reader", []string{kept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.collectOrphans(time.Now())
+	r.collectOrphans(time.Now().Add(2 * time.Hour))
+
+	// a subscription that lost the race with the reap, before
+	// the feed is fetched again
+	err = db.WriteFeed(orphan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BatchSubscribe("reader", []string{kept, orphan})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feeds, err := r.GetUserFeeds("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 1 || feeds[0] == nil || feeds[0].UpdateURL != kept {
+		t.Fatalf("expected only %s, got %v", kept, feeds)
+	}
+}
+
+func TestRefetchResubscribed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>back again</title></channel></rss>`)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{OrphanGrace: time.Hour})
+	u := srv.URL + "/feed"
+	err := r.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := db.ReapOrphanedFeeds(time.Now(), time.Hour)
+	if err == nil {
+		urls, err = db.ReapOrphanedFeeds(time.Now().Add(2*time.Hour), time.Hour)
+	}
+	if err != nil || !slices.Equal(urls, []string{u}) {
+		t.Fatalf("expected %s to be reaped, got %q, %v", u, urls, err)
+	}
+
+	// a subscription lands while the feed is still in the reaper
+	err = db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteFeed(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BatchSubscribe("reader", []string{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	r.removeFeedLocked(u)
+	r.mu.Unlock()
+	r.refetchResubscribed(urls)
+	if !r.HasFeed(u) {
+		t.Fatal("expected the resubscribed feed to be fetched again")
+	}
+}
+
+func TestReapedFeedsAreNotBackedOff(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
+
+	// a refresh of a feed that's been reaped fails afterwards
+	r.handleFeedFetchFailure("https://gone.example/feed", fmt.Errorf("connection refused"))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.backoff) != 0 {
+		t.Fatalf("expected no backoff for a feed that's gone, got %v", r.backoff)
+	}
+}
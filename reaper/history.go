@@ -0,0 +1,120 @@
+package reaper
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"git.j3s.sh/vore/sqlite"
+)
+
+// fetchTrace collects what a single fetch did on the wire, so
+// that it can be written to the fetch history afterwards.
+type fetchTrace struct {
+	start  time.Time
+	status int
+	bytes  atomic.Int64
+}
+
+func newFetchTrace() *fetchTrace {
+	return &fetchTrace{start: time.Now()}
+}
+
+// countingBody adds every byte read through it to a trace.
+type countingBody struct {
+	io.ReadCloser
+	trace *fetchTrace
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.trace.bytes.Add(int64(n))
+	return n, err
+}
+
+// attempt turns the trace into a history entry for a fetch that
+// ended with fetchErr (nil for success) & found newItems.
+func (t *fetchTrace) attempt(fetchErr error, newItems int) sqlite.FetchAttempt {
+	a := sqlite.FetchAttempt{
+		At:       t.start,
+		Status:   t.status,
+		Duration: time.Since(t.start),
+		Bytes:    t.bytes.Load(),
+		NewItems: newItems,
+	}
+	if fetchErr != nil {
+		a.ErrorClass = classifyFetchError(fetchErr, t.status)
+		a.Error = fetchErr.Error()
+	}
+	return a
+}
+
+// classifyFetchError sorts a failed fetch into a broad category,
+// so that the health page can tell "the host is down" apart from
+// "the feed is broken".
+func classifyFetchError(err error, status int) string {
+	if status >= 400 {
+		return fmt.Sprintf("http %d", status)
+	}
+
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return "tls"
+	case errors.As(err, &opErr):
+		return "connection"
+	case status != 0:
+		// we got a response, but couldn't make sense of it
+		return "parse"
+	}
+	return "other"
+}
+
+// recordAttempt writes a fetch attempt to the feed's history.
+func (r *Reaper) recordAttempt(url string, a sqlite.FetchAttempt) {
+	outcome := "ok"
+	if !a.OK() {
+		outcome = a.ErrorClass
+	}
+	fetchesTotal.Inc(outcome)
+
+	err := r.db.RecordFetchAttempt(url, a)
+	if err != nil {
+		log.Printf("reaper: could not record fetch of %s: %s\n", url, err)
+	}
+}
+
+// pruneFetchHistory deletes fetch history older than the
+// configured retention, every hour, until the reaper stops.
+// it should only be started if there is a retention.
+func (r *Reaper) pruneFetchHistory() {
+	for {
+		n, err := r.db.PruneFetchAttempts(time.Now().Add(-r.cfg.FetchHistoryRetention))
+		if err != nil {
+			log.Printf("reaper: could not prune fetch history: %s\n", err)
+		} else if n > 0 {
+			log.Printf("reaper: pruned %d old fetch attempts\n", n)
+		}
+		if !r.sleep(time.Hour) {
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchHistory(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing.Load() {
+			http.Error(w, "oh no", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>history</title>
+			<item><guid>1</guid><link>http://example.com/1</link><title>post 1</title></item>
+			</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
+	u := srv.URL + "/feed"
+	err := r.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	stale := snapshot(r.GetFeed(u))
+	stale.Refresh = time.Time{}
+	r.addFeed(stale)
+	r.refreshFeed(stale)
+
+	attempts, err := db.GetFetchAttempts(u, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 fetch attempts, got %d", len(attempts))
+	}
+
+	// newest first
+	failed, ok := attempts[0], attempts[1]
+	if failed.OK() || failed.Status != 500 || failed.ErrorClass != "http 500" || failed.Error == "" {
+		t.Fatalf("unexpected failed attempt %+v", failed)
+	}
+	if !ok.OK() || ok.Status != 200 || ok.NewItems != 1 || ok.Bytes == 0 {
+		t.Fatalf("unexpected successful attempt %+v", ok)
+	}
+
+	stats, err := db.GetFetchStats(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Attempts != 2 || stats.Successes != 1 || stats.SuccessRate() != 50 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	n, err := db.PruneFetchAttempts(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected to prune 2 attempts, pruned %d", n)
+	}
+}
+
+func TestClassifyFetchError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		want   string
+	}{
+		{errors.New("whatever"), 404, "http 404"},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), 0, "timeout"},
+		{&net.DNSError{Err: "no such host", Name: "nope.invalid"}, 0, "dns"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, 0, "connection"},
+		{errors.New("unrecognized feed format"), 200, "parse"},
+		{errors.New("feed has no URL"), 0, "other"},
+	}
+	for _, test := range tests {
+		got := classifyFetchError(test.err, test.status)
+		if got != test.want {
+			t.Errorf("classifyFetchError(%q, %d) = %q, want %q", test.err, test.status, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package reaper
+
+import "git.j3s.sh/vore/metrics"
+
+var (
+	fetchesTotal = metrics.NewCounter("vore_reaper_fetches_total",
+		"Feed fetches, by outcome: ok, or the class of error.", "outcome")
+	refreshDuration = metrics.NewHistogram("vore_reaper_refresh_duration_seconds",
+		"How long scheduled feed refreshes took, including any wait to be polite to the host.", nil)
+	feedsReaped = metrics.NewCounter("vore_reaper_feeds_reaped_total",
+		"Feeds deleted after going without subscribers for the grace period.")
+)
+
+// registerGauges exposes the reaper's current state as metrics.
+func (r *Reaper) registerGauges() {
+	metrics.NewGaugeFunc("vore_reaper_feeds",
+		"Feeds the reaper is maintaining.", func() float64 {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return float64(len(r.feeds))
+		})
+	metrics.NewGaugeFunc("vore_reaper_feeds_backing_off",
+		"Feeds that are backing off after failing to fetch.", func() float64 {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return float64(len(r.backoff))
+		})
+	metrics.NewGaugeFunc("vore_reaper_refreshes_in_flight",
+		"Feed refreshes currently running.", func() float64 {
+			return float64(len(r.workers))
+		})
+}
@@ -0,0 +1,177 @@
+package reaper
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// hostLimiter keeps the reaper polite: it caps how many fetches
+// may be in flight to a single host at once, and how soon after
+// one fetch starts the next fetch to the same host may start.
+// a zero concurrency or interval disables that limit.
+type hostLimiter struct {
+	concurrency int
+	interval    time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+	// lastEvict is when idle hosts were last forgotten
+	lastEvict time.Time
+}
+
+type hostState struct {
+	// slots is a semaphore with one slot per allowed fetch
+	slots chan struct{}
+
+	// next is the earliest time the next fetch may start
+	next time.Time
+
+	// users counts the fetches that hold or are waiting for
+	// this host, so that it isn't evicted from under them
+	users int
+}
+
+// how often the limiter forgets hosts that it's done with
+const hostEvictInterval = 10 * time.Minute
+
+func newHostLimiter(concurrency int, interval time.Duration) *hostLimiter {
+	return &hostLimiter{
+		concurrency: concurrency,
+		interval:    interval,
+		hosts:       make(map[string]*hostState),
+	}
+}
+
+// acquire blocks until a fetch to host may start, and returns
+// how long that took. release must be called once the fetch
+// is completely done with. if ctx is done first, the wait is
+// given up on & ctx's error is returned.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), waited time.Duration, err error) {
+	start := time.Now()
+
+	l.mu.Lock()
+	l.evictIdle(start)
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostState{}
+		if l.concurrency > 0 {
+			h.slots = make(chan struct{}, l.concurrency)
+		}
+		l.hosts[host] = h
+	}
+	h.users++
+	l.mu.Unlock()
+
+	done := func() {
+		l.mu.Lock()
+		h.users--
+		l.mu.Unlock()
+	}
+	release = done
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			done()
+			return nil, time.Since(start), ctx.Err()
+		}
+		release = func() {
+			<-h.slots
+			done()
+		}
+	}
+
+	// reserve the next start time while holding the lock,
+	// then wait for it without holding anything
+	l.mu.Lock()
+	now := time.Now()
+	at := now
+	if h.next.After(now) {
+		at = h.next
+	}
+	h.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait := at.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, time.Since(start), ctx.Err()
+		}
+	}
+	return release, time.Since(start), nil
+}
+
+// evictIdle forgets the hosts that nobody is fetching from or
+// waiting on & that could be fetched from straight away, so that
+// hosts the reaper has stopped fetching from don't pile up. it
+// does nothing if it's run within hostEvictInterval of the last
+// time. l.mu must be held.
+func (l *hostLimiter) evictIdle(now time.Time) {
+	if now.Sub(l.lastEvict) < hostEvictInterval {
+		return
+	}
+	l.lastEvict = now
+	for host, h := range l.hosts {
+		if h.users == 0 && !h.next.After(now) {
+			delete(l.hosts, host)
+		}
+	}
+}
+
+// hostname returns the host a fetch of rawURL will go to.
+func hostname(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Hostname()
+}
+
+// interleaveByHost reorders feed urls so that consecutive urls
+// are on different hosts where possible. this keeps the workers
+// busy with other hosts while one host's politeness limits kick in.
+func interleaveByHost(urls []string) []string {
+	var hosts []string
+	byHost := make(map[string][]string)
+	for _, u := range urls {
+		h := hostname(u)
+		if _, ok := byHost[h]; !ok {
+			hosts = append(hosts, h)
+		}
+		byHost[h] = append(byHost[h], u)
+	}
+
+	result := make([]string, 0, len(urls))
+	for len(result) < len(urls) {
+		for _, h := range hosts {
+			if len(byHost[h]) == 0 {
+				continue
+			}
+			result = append(result, byHost[h][0])
+			byHost[h] = byHost[h][1:]
+		}
+	}
+	return result
+}
+
+// releaseOnClose calls release when the response body it
+// wraps is closed, so that a host's concurrency slot is
+// held until the whole body has been read.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
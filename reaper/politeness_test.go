@@ -0,0 +1,150 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterConcurrency(t *testing.T) {
+	l := newHostLimiter(2, 0)
+
+	var inFlight, most atomic.Int64
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, _, err := l.acquire(context.Background(), "example.org")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			n := inFlight.Add(1)
+			for {
+				m := most.Load()
+				if n <= m || most.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			inFlight.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if most.Load() != 2 {
+		t.Fatalf("expected at most 2 fetches in flight, got %d", most.Load())
+	}
+}
+
+func TestHostLimiterInterval(t *testing.T) {
+	l := newHostLimiter(0, 20*time.Millisecond)
+
+	start := time.Now()
+	for range 3 {
+		release, _, err := l.acquire(context.Background(), "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected 3 fetches to take at least 40ms, took %s", elapsed)
+	}
+
+	// other hosts are unaffected
+	release, waited, err := l.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if waited > 10*time.Millisecond {
+		t.Fatalf("expected no wait for a new host, waited %s", waited)
+	}
+}
+
+func TestHostLimiterGivesUp(t *testing.T) {
+	for name, l := range map[string]*hostLimiter{
+		"concurrency": newHostLimiter(1, 0),
+		"interval":    newHostLimiter(0, time.Hour),
+	} {
+		release, _, err := l.acquire(context.Background(), "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, waited, err := l.acquire(ctx, "example.org")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the wait to be given up on, got %v", name, err)
+		}
+		if waited > time.Second {
+			t.Errorf("%s: expected to give up after 10ms, waited %s", name, waited)
+		}
+		release()
+
+		if users := l.hosts["example.org"].users; users != 0 {
+			t.Errorf("%s: expected nobody to be using the host, got %d", name, users)
+		}
+	}
+}
+
+func TestHostLimiterEvictsIdleHosts(t *testing.T) {
+	l := newHostLimiter(1, 0)
+	release, _, err := l.acquire(context.Background(), "busy.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	idle, _, err := l.acquire(context.Background(), "idle.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle()
+
+	// pretend it's been a while since the last eviction
+	l.lastEvict = time.Time{}
+	other, _, err := l.acquire(context.Background(), "other.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	if _, ok := l.hosts["idle.example"]; ok {
+		t.Error("expected the idle host to be evicted")
+	}
+	if _, ok := l.hosts["busy.example"]; !ok {
+		t.Error("expected the busy host to be kept")
+	}
+}
+
+func TestInterleaveByHost(t *testing.T) {
+	urls := []string{
+		"https://a.example/1",
+		"https://a.example/2",
+		"https://a.example/3",
+		"https://b.example/1",
+		"https://c.example/1",
+		"https://c.example/2",
+	}
+
+	want := []string{
+		"https://a.example/1",
+		"https://b.example/1",
+		"https://c.example/1",
+		"https://a.example/2",
+		"https://c.example/2",
+		"https://a.example/3",
+	}
+	got := interleaveByHost(urls)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
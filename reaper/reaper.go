@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -15,163 +17,567 @@ import (
 )
 
 type Reaper struct {
+	// mu guards feeds, backoff & plans
+	mu sync.RWMutex
+
 	// internal list of all rss feeds where the map
 	// key represents the url of the feed (which should be unique)
+	//
+	// the feeds in here are snapshots, and must never be modified
+	// once stored: refreshes work on a copy of the feed & swap it
+	// in when they're done, so readers never see a half-updated feed.
 	feeds map[string]*rss.Feed
 
-	db *sqlite.DB
+	// feeds that are failing to fetch, keyed by url. these
+	// are skipped until their next attempt time comes around.
+	backoff map[string]backoff
+
+	// how often each feed is refreshed & why, keyed by url
+	plans map[string]RefreshPlan
+
+	// limits how hard any one host gets hit
+	limiter *hostLimiter
+
+	// hands out feeds as they fall due for a refresh
+	sched *scheduler
+
+	// clock decides when feeds are due, for the scheduler
+	// & everything else
+	clock Clock
+
+	// one slot per refresh in flight
+	workers chan struct{}
+
+	// no new work is started once ctx is done, and running
+	// tracks the work that's still going so it can be waited for
+	ctx     context.Context
+	running sync.WaitGroup
+
+	cfg Config
+	db  *sqlite.DB
 }
 
-func (r *Reaper) fetchFunc() rss.FetchFunc {
+// Config holds the parts of the reaper that operators can tune.
+type Config struct {
+	// HostConcurrency is the most fetches that may be in flight
+	// to a single host at once. zero means no limit.
+	HostConcurrency int
+
+	// HostInterval is the minimum time between the start of two
+	// fetches to the same host. zero means no limit.
+	HostInterval time.Duration
+
+	// RefreshFloor and RefreshCeiling bound the refresh interval
+	// worked out from how often a feed posts. a ttl set by the
+	// feed itself is not bound by either. zero means no limit.
+	RefreshFloor   time.Duration
+	RefreshCeiling time.Duration
+
+	// FetchHistoryRetention is how long fetch attempts are kept
+	// for the feed health page. zero keeps them forever.
+	FetchHistoryRetention time.Duration
+
+	// OrphanGrace is how long a feed may go without subscribers
+	// before it's deleted. zero keeps orphaned feeds forever.
+	OrphanGrace time.Duration
+
+	// Clock is what the reaper tells the time by when it plans
+	// & schedules refreshes. nil means the system clock.
+	Clock Clock
+}
+
+type backoff struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+const (
+	// backoffBase is how long a feed that failed once is left
+	// alone for. every further failure in a row doubles it.
+	backoffBase = 30 * time.Minute
+
+	// backoffMax caps the wait, so dead feeds are still retried
+	// daily & come back on their own if the host recovers.
+	backoffMax = 24 * time.Hour
+)
+
+// backoffDelay returns how long to wait after the given
+// number of consecutive failures.
+func backoffDelay(failures int) time.Duration {
+	d := backoffBase
+	for i := 1; i < failures && d < backoffMax; i++ {
+		d *= 2
+	}
+	return min(d, backoffMax)
+}
+
+// fetchFunc returns the FetchFunc used for all reaper requests.
+// if f is non-nil, its validators are sent along so that
+// unchanged feeds can answer with a cheap 304. the response
+// status & size are noted in trace. requests are abandoned if
+// ctx is done.
+func (r *Reaper) fetchFunc(ctx context.Context, f *rss.Feed, trace *fetchTrace) rss.FetchFunc {
 	reaperFetchFunc := func(url string) (resp *http.Response, err error) {
 		client := http.Client{
 			Timeout: 20 * time.Second,
 		}
 
-		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		release, waited, err := r.limiter.acquire(ctx, req.URL.Hostname())
 		if err != nil {
 			return nil, err
 		}
+		if waited > 10*time.Millisecond {
+			log.Printf("reaper: delayed fetch of %s by %s to be polite to %s\n",
+				url, waited.Round(time.Millisecond), req.URL.Hostname())
+		}
 
 		req.Header.Set("User-Agent", "vore: feed fetcher")
 
-		fid, exists := r.db.GetFeedIDAndExists(url)
-		if exists {
-			subs := r.db.GetSubscriberCount(url)
-			ua := fmt.Sprintf("Vore feed-id:%d - %d subscribers", fid, subs)
+		// the plain user agent will do if the db is having a moment
+		ua, err := r.userAgent(url)
+		if err != nil {
+			log.Printf("reaper: could not look up subscribers of %s: %s\n", url, err)
+		} else if ua != "" {
 			req.Header.Set("User-Agent", ua)
 		}
 
-		return client.Do(req)
+		// a 304 is only useful if we have items to keep; an empty
+		// stub must always download the full body.
+		if f != nil && len(f.Items) > 0 {
+			if f.ETag != "" {
+				req.Header.Set("If-None-Match", f.ETag)
+			}
+			if f.LastModified != "" {
+				req.Header.Set("If-Modified-Since", f.LastModified)
+			}
+		}
+
+		resp, err = client.Do(req)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		trace.status = resp.StatusCode
+		resp.Body = &releaseOnClose{
+			ReadCloser: &countingBody{ReadCloser: resp.Body, trace: trace},
+			release:    release,
+		}
+		return resp, nil
 	}
 	return reaperFetchFunc
 }
 
-func New(db *sqlite.DB) *Reaper {
+// New returns a reaper that keeps every feed in db refreshed
+// until ctx is done. use Wait to let it finish up after that.
+func New(ctx context.Context, db *sqlite.DB, cfg Config) (*Reaper, error) {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
 	r := &Reaper{
-		feeds: make(map[string]*rss.Feed),
-		db:    db,
+		feeds:   make(map[string]*rss.Feed),
+		backoff: make(map[string]backoff),
+		plans:   make(map[string]RefreshPlan),
+		limiter: newHostLimiter(cfg.HostConcurrency, cfg.HostInterval),
+		sched:   newScheduler(clock),
+		clock:   clock,
+		// i chose 20 workers somewhat arbitrarily
+		workers: make(chan struct{}, 20),
+		ctx:     ctx,
+		cfg:     cfg,
+		db:      db,
+	}
+
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.registerGauges()
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		r.start()
+	}()
+
+	return r, nil
+}
+
+// userAgent tells the owner of the feed at url who we are &
+// how many people are reading. it's "" for unknown feeds.
+func (r *Reaper) userAgent(url string) (string, error) {
+	fid, exists, err := r.db.GetFeedIDAndExists(url)
+	if err != nil || !exists {
+		return "", err
+	}
+	subs, err := r.db.GetSubscriberCount(url)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Vore feed-id:%d - %d subscribers", fid, subs), nil
+}
+
+// Wait blocks until the reaper has wrapped up every refresh that
+// was in flight when its context was done, or until ctx is done.
+// fetches that were under way are abandoned.
+func (r *Reaper) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleep waits for d, and reports whether the reaper is still
+// running afterwards.
+func (r *Reaper) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// goBackground runs fn in its own goroutine, tracked by Wait.
+func (r *Reaper) goBackground(fn func()) {
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		fn()
+	}()
+}
+
+// load populates the reaper with every feed in the database, as
+// it was last cached, so that timelines can be served before
+// the first refresh has finished.
+func (r *Reaper) load() error {
+	start := time.Now()
+	urls, err := r.db.GetAllFeedURLs()
+	if err != nil {
+		return err
 	}
 
-	go r.start()
+	for _, url := range urls {
+		feed, err := r.db.GetFeedCache(url)
+		if err != nil {
+			log.Printf("reaper: could not load cached feed %s: %s\n", url, err)
+			// Setting UpdateURL lets us defer fetching
+			feed = &rss.Feed{
+				UpdateURL: url,
+			}
+		}
+		r.addFeed(feed)
+		// the cached refresh time stands, but the plan is
+		// worth having for the feed details page
+		r.setPlan(url, planRefresh(feed, r.clock.Now(), r.cfg.RefreshFloor, r.cfg.RefreshCeiling))
 
-	return r
+		state, err := r.db.GetFeedFetchState(url)
+		if err != nil {
+			log.Printf("reaper: could not load fetch state for %s: %s\n", url, err)
+			continue
+		}
+		if state.Failures > 0 || state.Error != "" {
+			r.backoff[url] = backoff{
+				failures:    state.Failures,
+				nextAttempt: state.NextAttempt,
+			}
+		}
+	}
+	for _, url := range urls {
+		r.scheduleFeed(url)
+	}
+	log.Printf("reaper: loaded %d feeds from cache in %s\n", len(urls), time.Since(start))
+	return nil
 }
 
-// Start initializes the reaper by populating a list of feeds from the database
-// and periodically refreshes all feeds every 15 minutes, if the feeds are
-// stale.
+// start refreshes each feed as soon as it falls due, until the
+// reaper's context is done.
 // reaper should only ever be started once (in New)
 func (r *Reaper) start() {
-	urls := r.db.GetAllFeedURLs()
+	if r.cfg.FetchHistoryRetention > 0 {
+		r.goBackground(r.pruneFetchHistory)
+	}
+	if r.cfg.OrphanGrace > 0 {
+		r.goBackground(r.collectOrphansHourly)
+	}
+	r.sched.run(r.ctx, r.dispatch)
+	log.Println("reaper: stopped scheduling refreshes")
+}
 
-	for _, url := range urls {
-		// Setting UpdateURL lets us defer fetching
-		feed := &rss.Feed{
-			UpdateURL: url,
+// dispatch refreshes the given feeds on the worker pool. it
+// blocks while every worker is busy, and gives up on whatever
+// is left once the reaper's context is done.
+func (r *Reaper) dispatch(urls []string) {
+	for _, url := range interleaveByHost(urls) {
+		select {
+		case r.workers <- struct{}{}:
+		case <-r.ctx.Done():
+			return
 		}
-		r.feeds[url] = feed
+		r.goBackground(func() {
+			defer func() { <-r.workers }()
+			r.refreshDue(url)
+		})
 	}
+}
 
-	for {
+// refreshDue refreshes the feed at url if it's still around
+// & stale, then queues up its next refresh.
+func (r *Reaper) refreshDue(url string) {
+	f := r.GetFeed(url)
+	if f == nil {
+		return
+	}
+	if !f.Refresh.After(r.clock.Now()) {
 		start := time.Now()
-		log.Println("reaper: refreshing all feeds")
-		r.refreshAllFeeds()
-		log.Printf("reaper: refreshed all feeds in %s! going to sleep 😴\n", time.Since(start))
-		time.Sleep(15 * time.Minute)
+		r.refreshFeed(f)
+		took := time.Since(start)
+		refreshDuration.Observe(took.Seconds())
+		log.Printf("reaper: %s refreshed in %s\n", url, took)
 	}
+	r.scheduleFeed(url)
+}
+
+// scheduleFeed queues the feed at url for its next refresh,
+// or for the end of its backoff if that's later.
+func (r *Reaper) scheduleFeed(url string) {
+	r.mu.RLock()
+	f, ok := r.feeds[url]
+	b, failing := r.backoff[url]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	due := f.Refresh
+	if failing && b.nextAttempt.After(due) {
+		due = b.nextAttempt
+	}
+	r.sched.schedule(url, due)
 }
 
 // Add the given rss feed to Reaper for maintenance.
 func (r *Reaper) addFeed(f *rss.Feed) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.feeds[f.UpdateURL] = f
 }
 
-// UpdateAll fetches every feed & attempts updating them
-// asynchronously, then prints the duration of the sync
-func (r *Reaper) refreshAllFeeds() {
-	ch := make(chan *rss.Feed)
-	var wg sync.WaitGroup
-	// i chose 20 workers somewhat arbitrarily
-	for i := 20; i > 0; i-- {
-		wg.Add(1)
+// plan works out how often f should be refreshed & moves
+// f.Refresh to match, out of any skipHours & skipDays the feed
+// asks for. f must not have been published yet.
+func (r *Reaper) plan(f *rss.Feed) RefreshPlan {
+	now := r.clock.Now()
+	p := planRefresh(f, now, r.cfg.RefreshFloor, r.cfg.RefreshCeiling)
+	f.Refresh = f.Skip(now.Add(p.Interval))
+	return p
+}
+
+func (r *Reaper) setPlan(url string, p RefreshPlan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plans[url] = p
+}
 
-		go func() {
-			defer wg.Done()
+// GetRefreshPlan returns how often the feed at url is being
+// refreshed, and why.
+func (r *Reaper) GetRefreshPlan(url string) (RefreshPlan, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.plans[url]
+	return p, ok
+}
 
-			for f := range ch {
-				start := time.Now()
-				r.refreshFeed(f)
-				log.Printf("reaper: %s refreshed in %s\n", f.UpdateURL, time.Since(start))
-			}
-		}()
+// swapFeed replaces old with next, unless old has been replaced
+// by somebody else in the meantime (e.g. a concurrent Fetch), in
+// which case next is thrown away. it reports whether it swapped.
+func (r *Reaper) swapFeed(old *rss.Feed, next *rss.Feed) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.feeds[old.UpdateURL] != old {
+		return false
 	}
+	r.feeds[next.UpdateURL] = next
+	return true
+}
 
-	for i := range r.feeds {
-		if r.feeds[i].Stale() {
-			ch <- r.feeds[i]
-		}
+// snapshot returns a copy of f that can be updated without
+// affecting readers of f. items are shared between the two,
+// since an item is never modified once it has been parsed.
+func snapshot(f *rss.Feed) *rss.Feed {
+	next := *f
+	next.Items = slices.Clone(f.Items)
+	if f.ItemMap != nil {
+		next.ItemMap = maps.Clone(f.ItemMap)
 	}
-
-	close(ch)
-	wg.Wait()
+	return &next
 }
 
-// refreshFeed triggers a fetch on the given feed,
-// and sets a fetch error in the db if there is one.
+// refreshFeed triggers a fetch on a copy of the given feed, sets
+// a fetch error in the db if there is one, and otherwise swaps
+// the refreshed copy in & writes it through to the db cache.
+// either way the attempt goes into the feed's fetch history.
+// the fetch is abandoned once the reaper's context is done, and
+// that isn't held against the feed.
 func (r *Reaper) refreshFeed(f *rss.Feed) {
-	f.FetchFunc = r.fetchFunc()
-	err := f.Update()
+	trace := newFetchTrace()
+	next := snapshot(f)
+	next.FetchFunc = r.fetchFunc(r.ctx, next, trace)
+	// the feed is due by r.clock, which is all that counts,
+	// so don't let Update second-guess it with the system's
+	next.Refresh = time.Time{}
+	err := next.Update()
+	if err != nil && r.ctx.Err() != nil {
+		log.Printf("reaper: gave up refreshing %s, the reaper is stopping\n", f.UpdateURL)
+		return
+	}
 	if err != nil {
+		r.recordAttempt(f.UpdateURL, trace.attempt(err, 0))
 		r.handleFeedFetchFailure(f.UpdateURL, err)
+		return
+	}
+	r.recordAttempt(f.UpdateURL, trace.attempt(nil, len(next.Items)-len(f.Items)))
+	r.handleFeedFetchSuccess(f.UpdateURL)
+	plan := r.plan(next)
+	if !r.swapFeed(f, next) {
+		log.Printf("reaper: %s was replaced during refresh, dropping update\n", f.UpdateURL)
+		return
 	}
+	r.setPlan(next.UpdateURL, plan)
+	r.writeFeedCache(next)
 }
 
-func (r *Reaper) handleFeedFetchFailure(url string, err error) {
-	log.Printf("reaper: failed to fetch %s: %s\n", url, err)
-	err = r.db.SetFeedFetchError(url, err.Error())
+func (r *Reaper) writeFeedCache(f *rss.Feed) {
+	err := r.db.WriteFeedCache(f)
+	if err != nil {
+		log.Printf("reaper: could not cache feed %s: %s\n", f.UpdateURL, err)
+	}
+}
+
+// handleFeedFetchFailure backs the feed off exponentially
+// & records the failure in the db, so it survives restarts.
+// feeds that have been removed from the reaper are left be.
+func (r *Reaper) handleFeedFetchFailure(url string, fetchErr error) {
+	r.mu.Lock()
+	if _, ok := r.feeds[url]; !ok {
+		// it was reaped while it was being fetched
+		r.mu.Unlock()
+		return
+	}
+	b := r.backoff[url]
+	b.failures++
+	b.nextAttempt = r.clock.Now().Add(backoffDelay(b.failures))
+	r.backoff[url] = b
+	r.mu.Unlock()
+
+	log.Printf("reaper: failed to fetch %s (%d in a row, backing off until %s): %s\n",
+		url, b.failures, b.nextAttempt.Format(time.RFC3339), fetchErr)
+	err := r.db.SetFeedFetchFailure(url, fetchErr.Error(), b.failures, b.nextAttempt)
 	if err != nil {
 		log.Printf("reaper: could not set feed fetch error '%s'\n", err)
 	}
 }
 
+// handleFeedFetchSuccess clears any backoff the feed was under.
+func (r *Reaper) handleFeedFetchSuccess(url string) {
+	r.mu.Lock()
+	b, failing := r.backoff[url]
+	delete(r.backoff, url)
+	r.mu.Unlock()
+	if !failing {
+		return
+	}
+
+	log.Printf("reaper: %s recovered after %d failures\n", url, b.failures)
+	err := r.db.ClearFeedFetchFailure(url)
+	if err != nil {
+		log.Printf("reaper: could not clear feed fetch error '%s'\n", err)
+	}
+}
+
 // HasFeed checks whether a given url is represented
 // in the reaper cache.
 func (r *Reaper) HasFeed(url string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if _, ok := r.feeds[url]; ok {
 		return true
 	}
 	return false
 }
 
+// GetFeed returns the current snapshot of the feed at url,
+// or nil. callers must not modify the returned feed.
 func (r *Reaper) GetFeed(url string) *rss.Feed {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.feeds[url]
 }
 
 // GetItem recurses through all rss feeds, returning the first
 // found feed by matching against the provided link
 func (r *Reaper) GetItem(url string) (*rss.Item, error) {
+	_, item, err := r.GetItemFeed(url)
+	return item, err
+}
+
+// GetItemFeed is GetItem, along with the feed the item was found
+// in. feeds are replaced rather than changed by a refresh, so the
+// feed can be read without holding any lock.
+func (r *Reaper) GetItemFeed(url string) (*rss.Feed, *rss.Item, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	for _, f := range r.feeds {
 		for _, i := range f.Items {
 			if i.Link == url {
-				return i, nil
+				return f, i, nil
 			}
 		}
 	}
-	return &rss.Item{}, errors.New("item not found")
+	return nil, &rss.Item{}, errors.New("item not found")
 }
 
-// GetUserFeeds returns a list of feeds
-func (r *Reaper) GetUserFeeds(username string) []*rss.Feed {
-	urls := r.db.GetUserFeedURLs(username)
+// GetUserFeeds returns snapshots of the feeds username is
+// subscribed to. feeds that the reaper doesn't have are left out.
+func (r *Reaper) GetUserFeeds(username string) ([]*rss.Feed, error) {
+	urls, err := r.db.GetUserFeedURLs(username)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
 	var result []*rss.Feed
+	var missing []string
 	for _, u := range urls {
-		// feeds in the db are guaranteed to be in reaper
-		result = append(result, r.feeds[u])
+		// a feed that's just been subscribed to can be in the
+		// db before it's in the reaper, until it's fetched
+		f, ok := r.feeds[u]
+		if !ok {
+			missing = append(missing, u)
+			continue
+		}
+		result = append(result, f)
+	}
+	r.mu.RUnlock()
+	for _, u := range missing {
+		log.Printf("reaper: %s subscribes to %s, which isn't being maintained\n", username, u)
 	}
 
 	r.SortFeeds(result)
-	return result
+	return result, nil
 }
 
 // SortFeeds sorts reaper feeds chronologically by date
@@ -197,7 +603,7 @@ func (r *Reaper) SortFeedItemsByDate(feeds []*rss.Feed) []*rss.Item {
 
 func (r *Reaper) TrimFuturePosts(items []*rss.Item) []*rss.Item {
 	var posts []*rss.Item
-	now := time.Now()
+	now := r.clock.Now()
 
 	for _, i := range items {
 		if !i.Date.After(now) {
@@ -210,14 +616,40 @@ func (r *Reaper) TrimFuturePosts(items []*rss.Item) []*rss.Item {
 }
 
 // Fetch attempts to fetch a feed from a given url, marshal
-// it into a feed object, and manage it via reaper.
+// it into a feed object, and manage it via reaper. the feed
+// is cached in the db straight away.
 func (r *Reaper) Fetch(url string) error {
-	feed, err := rss.FetchByFunc(r.fetchFunc(), url)
+	return r.FetchContext(context.Background(), url)
+}
+
+// Preview fetches & parses the feed at url without keeping it.
+// nothing is added to the reaper, cached, scheduled or recorded,
+// so it's safe to use on feeds nobody has subscribed to yet.
+func (r *Reaper) Preview(ctx context.Context, url string) (*rss.Feed, error) {
+	return rss.FetchByFunc(r.fetchFunc(ctx, nil, newFetchTrace()), url)
+}
+
+// FetchContext is Fetch, giving up if ctx is done first.
+func (r *Reaper) FetchContext(ctx context.Context, url string) error {
+	trace := newFetchTrace()
+	feed, err := rss.FetchByFunc(r.fetchFunc(ctx, nil, trace), url)
 	if err != nil {
+		r.recordAttempt(url, trace.attempt(err, 0))
 		return err
 	}
-
-	r.addFeed(feed)
-
+	r.AddFeed(feed)
+	r.recordAttempt(url, trace.attempt(nil, len(feed.Items)))
 	return nil
 }
+
+// AddFeed starts maintaining f, a feed that was just fetched with
+// Preview, as if it had been fetched with Fetch. this saves
+// fetching a feed twice to check it & then subscribe to it. f
+// must not be used by the caller afterwards.
+func (r *Reaper) AddFeed(f *rss.Feed) {
+	plan := r.plan(f)
+	r.addFeed(f)
+	r.setPlan(f.UpdateURL, plan)
+	r.writeFeedCache(f)
+	r.scheduleFeed(f.UpdateURL)
+}
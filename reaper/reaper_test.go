@@ -1,15 +1,44 @@
 package reaper
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"git.j3s.sh/vore/rss"
 	"git.j3s.sh/vore/sqlite"
 )
 
+func newTestDB(t *testing.T) *sqlite.DB {
+	t.Helper()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "vore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestReaper(t *testing.T, ctx context.Context, db *sqlite.DB, cfg Config) *Reaper {
+	t.Helper()
+	r, err := New(ctx, db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
 func TestHasFeed(t *testing.T) {
-	db := sqlite.New("go_test.db")
-	r := New(db)
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
 	f1 := rss.Feed{UpdateURL: "something"}
 	f2 := rss.Feed{UpdateURL: "strange"}
 	r.addFeed(&f1)
@@ -24,3 +53,382 @@ func TestHasFeed(t *testing.T) {
 		t.Fatal("reaper should have strange")
 	}
 }
+
+func TestLoadFromCache(t *testing.T) {
+	db := newTestDB(t)
+	cached := &rss.Feed{
+		UpdateURL: "https://example.org/feed.xml",
+		Title:     "cached feed",
+		// far enough out that the reaper won't try to refresh it
+		Refresh:   time.Now().Add(time.Hour).Round(time.Second),
+		ETag:      `"v1"`,
+		SkipHours: []int{1, 2},
+		SkipDays:  []string{"Sunday"},
+		Items: []*rss.Item{
+			{ID: "1", Title: "first", Link: "https://example.org/1"},
+			{ID: "2", Title: "second", Link: "https://example.org/2"},
+		},
+	}
+	err := db.WriteFeedCache(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReaper(t, context.Background(), db, Config{})
+	f := r.GetFeed(cached.UpdateURL)
+	if f == nil {
+		t.Fatal("reaper should have loaded the cached feed")
+	}
+	if f.Title != cached.Title || f.ETag != cached.ETag || !f.Refresh.Equal(cached.Refresh) {
+		t.Fatalf("got feed %q etag %q refresh %s, want %q %q %s",
+			f.Title, f.ETag, f.Refresh, cached.Title, cached.ETag, cached.Refresh)
+	}
+	if len(f.Items) != 2 || f.Items[0].Title != "first" || f.Items[1].Title != "second" {
+		t.Fatalf("got items %v, want first & second in order", f.Items)
+	}
+	if !slices.Equal(f.SkipHours, cached.SkipHours) || !slices.Equal(f.SkipDays, cached.SkipDays) {
+		t.Fatalf("got skip rules %v %v, want %v %v", f.SkipHours, f.SkipDays, cached.SkipHours, cached.SkipDays)
+	}
+	if _, err := r.GetItem("https://example.org/2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipHoursWithoutTTL(t *testing.T) {
+	// the feed may only be checked in one hour of the day
+	allowed := (time.Now().UTC().Hour() + 3) % 24
+	var hours strings.Builder
+	for h := range 24 {
+		if h != allowed {
+			fmt.Fprintf(&hours, "<hour>%d</hour>", h)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>sleepy</title>
+			<skipHours>%s</skipHours>
+			<item><guid>1</guid><link>http://example.org/1</link><title>post</title></item>
+			</channel></rss>`, hours.String())
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
+	err := r.Fetch(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.GetFeed(srv.URL)
+	if f.TTL != 0 {
+		t.Fatalf("didn't expect a ttl, got %s", f.TTL)
+	}
+	if got := f.Refresh.UTC().Hour(); got != allowed {
+		t.Errorf("expected the refresh in hour %d, got %s", allowed, f.Refresh.UTC())
+	}
+	plan, _ := r.GetRefreshPlan(srv.URL)
+	if !strings.Contains(plan.Reason, "skipped") {
+		t.Errorf("expected the plan to mention the skip rules, got %q", plan.Reason)
+	}
+}
+
+func TestConcurrentRefreshAndRead(t *testing.T) {
+	// every response carries a brand new item, so every
+	// refresh really does change the feed
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := hits.Add(1)
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>%s</title>
+			<item><guid>%d</guid><link>http://%s%s/%d</link><title>post %d</title>
+			<pubDate>Sun, 06 Sep 2009 16:45:00 +0000</pubDate></item>
+			</channel></rss>`, req.URL.Path, n, req.Host, req.URL.Path, n, n)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
+
+	var urls []string
+	for i := range 5 {
+		u := fmt.Sprintf("%s/feed/%d", srv.URL, i)
+		err := r.Fetch(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.BatchSubscribe("reader", urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// writers: force feeds stale & refresh them, plus the
+	// scheduler's own refreshes
+	for _, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				stale := snapshot(r.GetFeed(u))
+				stale.Refresh = time.Time{}
+				r.addFeed(stale)
+				r.refreshFeed(stale)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 3 {
+			for _, u := range urls {
+				r.refreshDue(u)
+			}
+		}
+	}()
+
+	// readers: everything the http handlers do
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				feeds, err := r.GetUserFeeds("reader")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, i := range r.SortFeedItemsByDate(feeds) {
+					_ = i.Title + i.Link
+				}
+				for _, u := range urls {
+					if !r.HasFeed(u) {
+						t.Errorf("reaper lost %s", u)
+					}
+					f := r.GetFeed(u)
+					_ = f.Title + f.UpdateURL
+				}
+				r.GetItem(urls[0] + "/1")
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for _, u := range urls {
+		f := r.GetFeed(u)
+		if len(f.Items) < 2 {
+			t.Errorf("%s: expected refreshes to add items, got %d", u, len(f.Items))
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Minute,
+		2:  time.Hour,
+		3:  2 * time.Hour,
+		6:  16 * time.Hour,
+		7:  24 * time.Hour,
+		50: 24 * time.Hour,
+	}
+	for failures, want := range tests {
+		if got := backoffDelay(failures); got != want {
+			t.Errorf("backoffDelay(%d): got %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestFetchFailureBackoff(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing.Load() {
+			http.Error(w, "oh no", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>flaky</title></channel></rss>`)
+	}))
+	defer srv.Close()
+
+	db := newTestDB(t)
+	r := newTestReaper(t, context.Background(), db, Config{})
+	u := srv.URL + "/feed"
+	err := r.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	for want := 1; want <= 2; want++ {
+		stale := snapshot(r.GetFeed(u))
+		stale.Refresh = time.Time{}
+		r.addFeed(stale)
+		r.refreshFeed(stale)
+
+		state, err := db.GetFeedFetchState(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Failures != want || state.Error == "" {
+			t.Fatalf("got %d failures & error %q, want %d & an error", state.Failures, state.Error, want)
+		}
+		if until := time.Until(state.NextAttempt); until < backoffDelay(want)-time.Minute {
+			t.Fatalf("expected to back off for %s, got %s", backoffDelay(want), until)
+		}
+		r.scheduleFeed(u)
+		if due, _ := r.sched.dueAt(u); due.Before(state.NextAttempt) {
+			t.Fatalf("feeds that are backing off should not be refreshed until %s, got %s", state.NextAttempt, due)
+		}
+	}
+
+	// the backoff is remembered across restarts
+	r = newTestReaper(t, context.Background(), db, Config{})
+	state, err := db.GetFeedFetchState(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := r.sched.dueAt(u); due.Before(state.NextAttempt) {
+		t.Fatalf("feeds that are backing off should not be refreshed until %s after a restart, got %s", state.NextAttempt, due)
+	}
+
+	failing.Store(false)
+	stale := snapshot(r.GetFeed(u))
+	stale.Refresh = time.Time{}
+	r.addFeed(stale)
+	r.refreshFeed(stale)
+	state, err = db.GetFeedFetchState(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != (sqlite.FeedFetchState{}) {
+		t.Fatalf("expected a successful fetch to clear the backoff, got %+v", state)
+	}
+}
+
+func TestShutdownAbandonsRefreshes(t *testing.T) {
+	var hits atomic.Int64
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the first fetch is the subscription; the refresh hangs
+		if hits.Add(1) > 1 {
+			started <- struct{}{}
+			select {
+			case <-release:
+			case <-req.Context().Done():
+			}
+		}
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>slow</title></channel></rss>`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db := newTestDB(t)
+	r := newTestReaper(t, ctx, db, Config{})
+	u := srv.URL + "/feed"
+	err := r.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := snapshot(r.GetFeed(u))
+	stale.Refresh = time.Time{}
+	r.addFeed(stale)
+	r.scheduleFeed(u)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stale feed was never refreshed")
+	}
+
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := r.Wait(waitCtx); err != nil {
+		t.Fatalf("expected the hanging refresh to be abandoned, got %v", err)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("expected no fetches after shutdown, got %d in total", hits.Load())
+	}
+	// stopping isn't the feed's fault
+	state, err := db.GetFeedFetchState(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != (sqlite.FeedFetchState{}) {
+		t.Fatalf("expected no fetch failure to be recorded, got %+v", state)
+	}
+}
+
+func TestRefreshesFollowTheClock(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>clockwork</title></channel></rss>`)
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	db := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newTestReaper(t, ctx, db, Config{Clock: clock})
+	u := srv.URL + "/feed"
+	err := r.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, ok := r.GetRefreshPlan(u)
+	if !ok {
+		t.Fatal("expected the feed to have a refresh plan")
+	}
+	due := r.GetFeed(u).Refresh
+	if want := clock.Now().Add(plan.Interval); !due.Equal(want) {
+		t.Fatalf("expected the refresh to be planned by the clock for %s, got %s", want, due)
+	}
+
+	// wait for the scheduler to go to sleep until then
+	for asleep := false; !asleep; {
+		select {
+		case timer := <-clock.created:
+			asleep = timer.at.Equal(due)
+		case <-time.After(time.Second):
+			t.Fatal("the feed was never scheduled")
+		}
+	}
+
+	// the feed isn't stale by the system clock, only by the fake one
+	clock.Advance(plan.Interval - time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected no refresh before the feed is due, got %d fetches", n)
+	}
+	clock.Advance(2 * time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.GetFeed(u).Refresh.Equal(due) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the feed was never refreshed, %d fetches", hits.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("expected one refresh once the feed was due, got %d fetches", n)
+	}
+	if want := clock.Now().Add(plan.Interval); !r.GetFeed(u).Refresh.Equal(want) {
+		t.Fatalf("expected the next refresh at %s, got %s", want, r.GetFeed(u).Refresh)
+	}
+}
@@ -0,0 +1,197 @@
+package reaper
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the reaper's view of time, so that tests can drive
+// it deterministically.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer the scheduler uses.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// scheduler hands out feed urls exactly when they're due. it
+// keeps a priority queue ordered by due time, and sleeps until
+// the earliest entry is due or the queue changes.
+type scheduler struct {
+	clock Clock
+
+	mu    sync.Mutex
+	queue dueQueue
+	// index points at each url's entry in queue
+	index map[string]*dueEntry
+
+	// wake nudges run whenever the queue changes
+	wake chan struct{}
+}
+
+func newScheduler(clock Clock) *scheduler {
+	return &scheduler{
+		clock: clock,
+		index: make(map[string]*dueEntry),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// schedule queues url to be handed out at due, replacing
+// any time it was already queued for.
+func (s *scheduler) schedule(url string, due time.Time) {
+	s.mu.Lock()
+	if e, ok := s.index[url]; ok {
+		e.due = due
+		heap.Fix(&s.queue, e.i)
+	} else {
+		e := &dueEntry{url: url, due: due}
+		heap.Push(&s.queue, e)
+		s.index[url] = e
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove takes url out of the queue, if it's queued.
+func (s *scheduler) remove(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.index[url]; ok {
+		heap.Remove(&s.queue, e.i)
+		delete(s.index, url)
+	}
+}
+
+// dueAt returns when url is queued for.
+func (s *scheduler) dueAt(url string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.index[url]; ok {
+		return e.due, true
+	}
+	return time.Time{}, false
+}
+
+// popDue removes & returns every url that is due at now, and
+// the due time of the next url in the queue, if there is one.
+func (s *scheduler) popDue(now time.Time) ([]string, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []string
+	for len(s.queue) > 0 && !s.queue[0].due.After(now) {
+		e := heap.Pop(&s.queue).(*dueEntry)
+		delete(s.index, e.url)
+		due = append(due, e.url)
+	}
+	if len(s.queue) == 0 {
+		return due, time.Time{}, false
+	}
+	return due, s.queue[0].due, true
+}
+
+// run hands due urls to dispatch until ctx is done. urls are
+// out of the queue while they're being dispatched; it's up to
+// dispatch to schedule them again.
+func (s *scheduler) run(ctx context.Context, dispatch func(urls []string)) {
+	for {
+		now := s.clock.Now()
+		due, next, ok := s.popDue(now)
+		if len(due) > 0 {
+			dispatch(due)
+			// dispatch can block, & the timer has to count
+			// from when it's armed
+			now = s.clock.Now()
+		}
+
+		var timer Timer
+		var fire <-chan time.Time
+		if ok {
+			timer = s.clock.NewTimer(next.Sub(now))
+			fire = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-fire:
+		case <-s.wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+type dueEntry struct {
+	url string
+	due time.Time
+	// i is the entry's position in the heap
+	i int
+}
+
+// dueQueue is a container/heap of entries, earliest due first.
+type dueQueue []*dueEntry
+
+func (q dueQueue) Len() int {
+	return len(q)
+}
+
+func (q dueQueue) Less(i, j int) bool {
+	return q[i].due.Before(q[j].due)
+}
+
+func (q dueQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].i = i
+	q[j].i = j
+}
+
+func (q *dueQueue) Push(x any) {
+	e := x.(*dueEntry)
+	e.i = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *dueQueue) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
@@ -0,0 +1,209 @@
+package reaper
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when told to. timers fire once Advance
+// moves the clock past them.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// created receives new timers while it has room, so tests
+	// can wait until the scheduler has gone to sleep
+	created chan *fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		created: make(chan *fakeTimer, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	// a whole reaper makes more timers than anyone waits for
+	select {
+	case c.created <- t:
+	default:
+	}
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool {
+		if t.at.After(c.now) {
+			return false
+		}
+		t.c <- c.now
+		return true
+	})
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return true
+}
+
+// startScheduler runs s in the background, sending each batch of
+// dispatched urls down the returned channel.
+func startScheduler(t *testing.T, s *scheduler) <-chan []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	dispatched := make(chan []string, 100)
+	go func() {
+		defer close(done)
+		s.run(ctx, func(urls []string) {
+			dispatched <- urls
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return dispatched
+}
+
+func waitForTimer(t *testing.T, c *fakeClock) {
+	t.Helper()
+	select {
+	case <-c.created:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler never went to sleep")
+	}
+}
+
+func expectDispatch(t *testing.T, dispatched <-chan []string, want ...string) {
+	t.Helper()
+	select {
+	case got := <-dispatched:
+		if !slices.Equal(got, want) {
+			t.Fatalf("dispatched %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("nothing dispatched, want %q", want)
+	}
+}
+
+func expectNoDispatch(t *testing.T, dispatched <-chan []string) {
+	t.Helper()
+	select {
+	case got := <-dispatched:
+		t.Fatalf("dispatched %q too early", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSchedulerDispatchesInDueOrder(t *testing.T) {
+	clock := newFakeClock()
+	s := newScheduler(clock)
+	now := clock.Now()
+	s.schedule("c", now.Add(3*time.Hour))
+	s.schedule("a", now.Add(1*time.Hour))
+	s.schedule("b", now.Add(2*time.Hour))
+	dispatched := startScheduler(t, s)
+
+	for _, url := range []string{"a", "b", "c"} {
+		waitForTimer(t, clock)
+		clock.Advance(time.Hour - time.Second)
+		expectNoDispatch(t, dispatched)
+
+		clock.Advance(time.Second)
+		expectDispatch(t, dispatched, url)
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	clock := newFakeClock()
+	s := newScheduler(clock)
+	now := clock.Now()
+	s.schedule("a", now.Add(time.Hour))
+	s.schedule("b", now.Add(2*time.Hour))
+	s.schedule("a", now.Add(3*time.Hour))
+	s.remove("b")
+	dispatched := startScheduler(t, s)
+
+	waitForTimer(t, clock)
+	clock.Advance(2 * time.Hour)
+	expectNoDispatch(t, dispatched)
+
+	clock.Advance(time.Hour)
+	expectDispatch(t, dispatched, "a")
+	if _, ok := s.dueAt("a"); ok {
+		t.Fatal("dispatched urls should be out of the queue")
+	}
+}
+
+func TestSchedulerWakesForNewFeeds(t *testing.T) {
+	clock := newFakeClock()
+	s := newScheduler(clock)
+	s.schedule("later", clock.Now().Add(time.Hour))
+	dispatched := startScheduler(t, s)
+	waitForTimer(t, clock)
+
+	// the scheduler is asleep until "later" is due, but a new
+	// feed that's already due shouldn't have to wait for it
+	s.schedule("now", clock.Now())
+	expectDispatch(t, dispatched, "now")
+}
+
+func TestSchedulerTimerAfterSlowDispatch(t *testing.T) {
+	clock := newFakeClock()
+	s := newScheduler(clock)
+	start := clock.Now()
+	s.schedule("a", start)
+	s.schedule("b", start.Add(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, func(urls []string) {
+			// handing the urls off takes half an hour
+			clock.Advance(30 * time.Minute)
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case timer := <-clock.created:
+		if !timer.at.Equal(start.Add(time.Hour)) {
+			t.Errorf("expected the timer to go off when b is due, at %s, got %s", start.Add(time.Hour), timer.at)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scheduler never went to sleep")
+	}
+}
@@ -1,8 +1,8 @@
 /*
-Package rss is a small library for simplifying the parsing of RSS and Atom feeds.
+Package rss is a small library for simplifying the parsing of RSS, Atom and JSON Feed feeds.
 
 The package could do with more testing, but it conforms to the RSS 1.0, 2.0, and Atom 1.0
-specifications, to the best of my ability. I've tested it with about 15 different feeds,
+specifications, to the best of my ability. JSON Feed 1.0 and 1.1 are also supported. I've tested it with about 15 different feeds,
 and it seems to work fine with them.
 
 If anyone has any problems with feeds being parsed incorrectly, please let me know so that
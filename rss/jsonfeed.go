@@ -0,0 +1,198 @@
+package rss
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func parseJSON(data []byte) (*Feed, error) {
+	warnings := false
+	feed := jsonFeed{}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(feed.Version, "https://jsonfeed.org/version/") {
+		return nil, fmt.Errorf("unknown JSON Feed version %q", feed.Version)
+	}
+
+	out := new(Feed)
+	out.Title = feed.Title
+	out.Language = feed.Language
+	out.Author = feed.authorNames()
+	out.Description = feed.Description
+	out.Link = feed.HomePageURL
+	// the favicon will do for a feed with no icon
+	icon := feed.Icon
+	if icon == "" {
+		icon = feed.Favicon
+	}
+	if icon != "" {
+		out.Image = &Image{URL: icon}
+	}
+	out.Refresh = time.Now().Add(DefaultRefreshInterval)
+
+	out.Items = make([]*Item, 0, len(feed.Items))
+	out.ItemMap = make(map[string]struct{})
+
+	// Process items.
+	for _, item := range feed.Items {
+
+		if item.ID == "" {
+			if item.URL == "" {
+				if debug {
+					fmt.Printf("[w] Item %q has no ID or URL and will be ignored.\n", item.Title)
+					fmt.Printf("[w] %#v\n", item)
+				}
+				warnings = true
+				continue
+			}
+			item.ID = jsonFeedID(item.URL)
+		}
+
+		// Skip items already known.
+		if _, ok := out.ItemMap[string(item.ID)]; ok {
+			continue
+		}
+
+		next := new(Item)
+		next.Title = item.Title
+		switch {
+		case item.Summary != "":
+			next.Summary = item.Summary
+		case item.ContentHTML != "":
+			next.Summary = item.ContentHTML
+		default:
+			next.Summary = item.ContentText
+		}
+		next.Categories = item.Tags
+		next.Link = item.URL
+		if next.Link == "" {
+			next.Link = item.ExternalURL
+		}
+		if item.Image != "" {
+			next.Image = &Image{URL: item.Image}
+		}
+		if item.DatePublished != "" {
+			next.Date, err = parseTime(item.DatePublished)
+			if err == nil {
+				next.DateValid = true
+			}
+		} else if item.DateModified != "" {
+			next.Date, err = parseTime(item.DateModified)
+			if err == nil {
+				next.DateValid = true
+			}
+		}
+		next.ID = string(item.ID)
+		if len(item.Attachments) > 0 {
+			next.Enclosures = make([]*Enclosure, len(item.Attachments))
+			for i := range item.Attachments {
+				next.Enclosures[i] = item.Attachments[i].Enclosure()
+			}
+		}
+		next.Read = false
+
+		out.Items = append(out.Items, next)
+		out.ItemMap[next.ID] = struct{}{}
+		out.Unread++
+	}
+
+	if warnings && debug {
+		fmt.Printf("[i] Encountered warnings:\n%s\n", data)
+	}
+
+	return out, nil
+}
+
+// jsonFeed covers both JSON Feed 1.0 and 1.1. 1.1 replaced
+// the singular author object with an authors array, so both
+// are decoded and authorNames picks whichever is present.
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description"`
+	Icon        string           `json:"icon"`
+	Favicon     string           `json:"favicon"`
+	Language    string           `json:"language"`
+	Author      *jsonFeedAuthor  `json:"author"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+func (f *jsonFeed) authorNames() string {
+	authors := f.Authors
+	if len(authors) == 0 && f.Author != nil {
+		authors = []jsonFeedAuthor{*f.Author}
+	}
+	var names []string
+	for _, a := range authors {
+		if a.Name != "" {
+			names = append(names, a.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+type jsonFeedAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Avatar string `json:"avatar"`
+}
+
+type jsonFeedItem struct {
+	ID            jsonFeedID           `json:"id"`
+	URL           string               `json:"url"`
+	ExternalURL   string               `json:"external_url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	Image         string               `json:"image"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Tags          []string             `json:"tags"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+// jsonFeedID is a string in the spec, but plenty of
+// feeds in the wild emit numeric ids, so accept both.
+type jsonFeedID string
+
+func (id *jsonFeedID) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = jsonFeedID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = jsonFeedID(n.String())
+	return nil
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Title    string `json:"title"`
+	Size     uint   `json:"size_in_bytes"`
+}
+
+func (a *jsonFeedAttachment) Enclosure() *Enclosure {
+	out := new(Enclosure)
+	out.URL = a.URL
+	out.Type = a.MimeType
+	out.Length = a.Size
+	return out
+}
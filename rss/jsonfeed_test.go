@@ -0,0 +1,126 @@
+package rss
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONFeed(t *testing.T) {
+	type result struct {
+		Title   string
+		Author  string
+		Link    string
+		Items   int
+		FirstID string
+		Date    string
+		Image   *Image
+	}
+	tests := map[string]result{
+		"json_1.0": {
+			Title:   "JSON Feed Weblog",
+			Author:  "Autor des Weblogs",
+			Link:    "https://example.org/",
+			Items:   2,
+			FirstID: "https://example.org/2017/05/17/second-post",
+			Date:    "2017-05-17 17:02:12 +0000 UTC",
+		},
+		"json_1.1": {
+			Title:   "JSON Feed Podcast",
+			Author:  "Alex, Sam",
+			Link:    "https://podcast.example.org/",
+			Items:   2,
+			FirstID: "episode-2",
+			Date:    "2021-02-03 12:00:00 +0000 UTC",
+			Image:   &Image{URL: "https://podcast.example.org/icon.png"},
+		},
+	}
+
+	for test, want := range tests {
+		name := filepath.Join("testdata", test)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Reading %s: %v", name, err)
+		}
+
+		feed, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parsing %s: %v", name, err)
+		}
+
+		got := result{
+			Title:  feed.Title,
+			Author: feed.Author,
+			Link:   feed.Link,
+			Items:  len(feed.Items),
+			Image:  feed.Image,
+		}
+		if len(feed.Items) > 0 {
+			got.FirstID = feed.Items[0].ID
+			got.Date = feed.Items[0].Date.UTC().String()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestParseJSONFeedItems(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "json_1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// numeric ids are accepted and stringified
+	if feed.Items[1].ID != "1" {
+		t.Errorf("got id %q, want %q", feed.Items[1].ID, "1")
+	}
+	// summary wins over content
+	if feed.Items[1].Summary != "Zusammenfassung des ersten Eintrags" {
+		t.Errorf("got summary %q", feed.Items[1].Summary)
+	}
+	if !reflect.DeepEqual(feed.Items[0].Categories, []string{"weblog", "json"}) {
+		t.Errorf("got categories %q", feed.Items[0].Categories)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join("testdata", "json_1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err = Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// external_url stands in for a missing url, date_modified
+	// for a missing date_published
+	if feed.Items[1].Link != "https://elsewhere.example.com/episode-1" {
+		t.Errorf("got link %q", feed.Items[1].Link)
+	}
+	if !feed.Items[1].DateValid {
+		t.Errorf("date %q invalid!", feed.Items[1].Date)
+	}
+}
+
+func TestParseJSONFeedFavicon(t *testing.T) {
+	feed, err := Parse([]byte(`{"version": "https://jsonfeed.org/version/1.1",
+		"title": "t", "favicon": "https://example.org/favicon.ico", "items": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Image == nil || feed.Image.URL != "https://example.org/favicon.ico" {
+		t.Errorf("expected the favicon to stand in for the icon, got %+v", feed.Image)
+	}
+}
+
+func TestParseJSONFeedBadVersion(t *testing.T) {
+	_, err := Parse([]byte(`{"version": "1", "title": "not a json feed"}`))
+	if err == nil {
+		t.Fatal("expected an error for an unknown version")
+	}
+}
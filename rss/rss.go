@@ -2,37 +2,121 @@ package rss
 
 import (
 	"bytes"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"text/tabwriter"
 	"time"
 )
 
-// Parse RSS or Atom data.
+// Parse RSS, Atom or JSON Feed data.
 func Parse(data []byte) (*Feed, error) {
+	format, root := detectFormat(data)
+	if debug {
+		fmt.Printf("[i] Parsing as %s\n", format)
+	}
 
-	if strings.Contains(string(data), "<rss") {
-		if debug {
-			fmt.Println("[i] Parsing as RSS 2.0")
+	var out *Feed
+	var err error
+	switch format {
+	case formatJSON:
+		out, err = parseJSON(data)
+	case formatRSS2:
+		out, err = parseRSS2(data)
+	case formatRSS1:
+		out, err = parseRSS1(data)
+	case formatAtom:
+		out, err = parseAtom(data)
+	default:
+		if root == "" {
+			return nil, errors.New("unrecognized feed format: no root element found")
 		}
-		return parseRSS2(data)
-	} else if strings.Contains(string(data), "xmlns=\"http://purl.org/rss/1.0/\"") {
-		if debug {
-			fmt.Println("[i] Parsing as RSS 1.0")
+		return nil, fmt.Errorf("unrecognized feed format: root element <%s>", root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing as %s: %w", format, err)
+	}
+	return out, nil
+}
+
+type feedFormat int
+
+const (
+	formatUnknown feedFormat = iota
+	formatRSS2
+	formatRSS1
+	formatAtom
+	formatJSON
+)
+
+func (f feedFormat) String() string {
+	switch f {
+	case formatRSS2:
+		return "RSS 2.0"
+	case formatRSS1:
+		return "RSS 1.0"
+	case formatAtom:
+		return "Atom"
+	case formatJSON:
+		return "JSON Feed"
+	}
+	return "unknown"
+}
+
+const (
+	nsRDF    = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsAtom   = "http://www.w3.org/2005/Atom"
+	nsAtom03 = "http://purl.org/atom/ns#"
+)
+
+// detectFormat works out which parser data needs by looking at
+// the first XML start element and its namespace, rather than
+// searching the whole document for markers that may just as
+// well appear inside escaped content. it also returns the name
+// of the root element, for error messages.
+func detectFormat(data []byte) (feedFormat, string) {
+	if isJSON(data) {
+		return formatJSON, ""
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.CharsetReader = charsetReader
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return formatUnknown, ""
 		}
-		return parseRSS1(data)
-	} else {
-		if debug {
-			fmt.Println("[i] Parsing as Atom")
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			// prolog, comments, doctypes & processing instructions
+			continue
+		}
+
+		switch {
+		case start.Name.Local == "rss":
+			return formatRSS2, start.Name.Local
+		case start.Name.Local == "RDF" && (start.Name.Space == nsRDF || start.Name.Space == "rdf"):
+			return formatRSS1, start.Name.Local
+		case start.Name.Local == "feed" && (start.Name.Space == nsAtom || start.Name.Space == nsAtom03 || start.Name.Space == ""):
+			return formatAtom, start.Name.Local
 		}
-		return parseAtom(data)
+		return formatUnknown, start.Name.Local
 	}
 }
 
+// isJSON reports whether data looks like a JSON document
+// rather than XML, i.e. it opens with an object.
+func isJSON(data []byte) bool {
+	data = bytes.TrimLeft(data, "\xef\xbb\xbf \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
 // A FetchFunc is a function that fetches a feed for given URL.
 type FetchFunc func(url string) (resp *http.Response, err error)
 
@@ -63,6 +147,10 @@ func FetchByFunc(fetchFunc FetchFunc, url string) (*Feed, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -79,28 +167,75 @@ func FetchByFunc(fetchFunc FetchFunc, url string) (*Feed, error) {
 
 	out.UpdateURL = url
 	out.FetchFunc = fetchFunc
+	out.ETag = resp.Header.Get("ETag")
+	out.LastModified = resp.Header.Get("Last-Modified")
 
 	return out, nil
 }
 
 // Feed is the top-level structure.
 type Feed struct {
-	Nickname    string              `json:"nickname"` // This is not set by the package, but could be helpful.
-	Title       string              `json:"title"`
-	Language    string              `json:"language"`
-	Author      string              `json:"author"`
-	Description string              `json:"description"`
-	Link        string              `json:"link"`      // Link to the creator's website.
-	UpdateURL   string              `json:"updateurl"` // URL of the feed itself.
-	Image       *Image              `json:"image"`     // Feed icon.
-	Categories  []string            `json:"categories"`
-	Items       []*Item             `json:"items"`
-	ItemMap     map[string]struct{} `json:"itemmap"` // Used in checking whether an item has been seen before.
-	Refresh     time.Time           `json:"refresh"` // Earliest time this feed should next be checked.
-	Unread      uint32              `json:"unread"`  // Number of unread items. Used by aggregators.
-	FetchFunc   FetchFunc           `json:"-"`
+	Nickname     string              `json:"nickname"` // This is not set by the package, but could be helpful.
+	Title        string              `json:"title"`
+	Language     string              `json:"language"`
+	Author       string              `json:"author"`
+	Description  string              `json:"description"`
+	Link         string              `json:"link"`      // Link to the creator's website.
+	UpdateURL    string              `json:"updateurl"` // URL of the feed itself.
+	Image        *Image              `json:"image"`     // Feed icon.
+	Categories   []string            `json:"categories"`
+	Items        []*Item             `json:"items"`
+	ItemMap      map[string]struct{} `json:"itemmap"`      // Used in checking whether an item has been seen before.
+	Refresh      time.Time           `json:"refresh"`      // Earliest time this feed should next be checked.
+	TTL          time.Duration       `json:"ttl"`          // Refresh interval the feed asked for (RSS ttl), if any.
+	SkipHours    []int               `json:"skiphours"`    // Hours (0-23, UTC) the feed asks not to be checked in (RSS skipHours).
+	SkipDays     []string            `json:"skipdays"`     // Days the feed asks not to be checked on (RSS skipDays).
+	Unread       uint32              `json:"unread"`       // Number of unread items. Used by aggregators.
+	ETag         string              `json:"etag"`         // ETag validator from the last fetch.
+	LastModified string              `json:"lastmodified"` // Last-Modified validator from the last fetch.
+	FetchFunc    FetchFunc           `json:"-"`
+}
+
+// Skip returns the first time from t on that the feed doesn't
+// ask to be skipped by its skipHours & skipDays. if those cover
+// the whole week, they're ignored.
+func (f *Feed) Skip(t time.Time) time.Time {
+	if len(f.SkipHours) == 0 && len(f.SkipDays) == 0 {
+		return t
+	}
+	next := t
+	for range 24 * 7 {
+		if !f.skips(next) {
+			return next
+		}
+		next = next.UTC().Truncate(time.Hour).Add(time.Hour)
+	}
+	return t
+}
+
+// skips reports whether t falls in the feed's skipHours or
+// skipDays, which are in UTC.
+func (f *Feed) skips(t time.Time) bool {
+	t = t.UTC()
+	for _, hour := range f.SkipHours {
+		if hour == t.Hour() {
+			return true
+		}
+	}
+	for _, day := range f.SkipDays {
+		if strings.EqualFold(strings.TrimSpace(day), t.Weekday().String()) {
+			return true
+		}
+	}
+	return false
 }
 
+// ErrNotModified is returned by FetchByFunc when the server
+// answers a conditional request with 304 Not Modified. The
+// FetchFunc is responsible for sending If-None-Match and
+// If-Modified-Since using a feed's ETag and LastModified.
+var ErrNotModified = errors.New("feed not modified")
+
 type refreshError string
 
 var _ net.Error = refreshError("")
@@ -132,6 +267,23 @@ var errUpdateNotReady refreshError = "not ready to update: too soon to refresh"
 // The default value is 12 hours.
 var DefaultRefreshInterval = 12 * time.Hour
 
+// MaxItems is how many items a feed keeps
+// once they have left the feed upstream.
+// Without a limit, a long-lived feed keeps
+// every item it has ever had, in memory
+// and wherever it is cached, for good.
+//
+// Items are dropped oldest first by date,
+// and an item that is still in the feed is
+// never dropped, so feeds that publish
+// more than MaxItems at once keep them all.
+// Items that are gone from the feed can't
+// be fetched again, so anything that needs
+// an item for longer should keep a copy.
+//
+// The default value is 200.
+var MaxItems = 200
+
 // Update fetches any new items and updates f.
 func (f *Feed) Update() error {
 	if f.FetchFunc == nil {
@@ -162,13 +314,28 @@ func (f *Feed) UpdateByFunc(fetchFunc FetchFunc) error {
 	}
 
 	update, err := FetchByFunc(fetchFunc, f.UpdateURL)
+	if errors.Is(err, ErrNotModified) {
+		// nothing changed upstream, so there's nothing to merge.
+		// push the refresh out as if we'd parsed an identical feed.
+		if f.TTL > 0 {
+			f.Refresh = f.Skip(time.Now().Add(f.TTL))
+		} else {
+			f.Refresh = f.Skip(time.Now().Add(DefaultRefreshInterval))
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	f.Refresh = update.Refresh
+	f.TTL = update.TTL
+	f.SkipHours = update.SkipHours
+	f.SkipDays = update.SkipDays
 	f.Title = update.Title
 	f.Description = update.Description
+	f.ETag = update.ETag
+	f.LastModified = update.LastModified
 
 	for _, item := range update.Items {
 		if _, ok := f.ItemMap[item.ID]; !ok {
@@ -177,10 +344,51 @@ func (f *Feed) UpdateByFunc(fetchFunc FetchFunc) error {
 			f.Unread++
 		}
 	}
+	f.trimItems(update)
 
 	return nil
 }
 
+// trimItems drops the oldest items that are no longer in
+// current, the feed as it was just fetched, until at most
+// MaxItems are left. Items without a date count as older than
+// any with one, and items with the same date go in the order
+// they arrived. Dropped items are forgotten by ItemMap too, so
+// that it doesn't grow without bound either.
+func (f *Feed) trimItems(current *Feed) {
+	drop := len(f.Items) - MaxItems
+	if drop <= 0 {
+		return
+	}
+	inFeed := make(map[string]bool, len(current.Items))
+	for _, item := range current.Items {
+		inFeed[item.ID] = true
+	}
+	var departed []*Item
+	for _, item := range f.Items {
+		if !inFeed[item.ID] {
+			departed = append(departed, item)
+		}
+	}
+	// invalid dates are left zero, so they sort first
+	slices.SortStableFunc(departed, func(a, b *Item) int {
+		return a.Date.Compare(b.Date)
+	})
+	dropped := make(map[*Item]bool)
+	for _, item := range departed[:min(drop, len(departed))] {
+		dropped[item] = true
+		delete(f.ItemMap, item.ID)
+	}
+
+	kept := make([]*Item, 0, len(f.Items)-len(dropped))
+	for _, item := range f.Items {
+		if !dropped[item] {
+			kept = append(kept, item)
+		}
+	}
+	f.Items = kept
+}
+
 func (f *Feed) Stale() bool {
 	return f.Refresh.Before(time.Now())
 }
@@ -195,7 +403,9 @@ func (f *Feed) String() string {
 		fmt.Fprintf(w, "\xff\t\xffDescription:\t%q\n", f.Description)
 		fmt.Fprintf(w, "\xff\t\xffLink:\t%q\n", f.Link)
 		fmt.Fprintf(w, "\xff\t\xffUpdateURL:\t%q\n", f.UpdateURL)
-		fmt.Fprintf(w, "\xff\t\xffImage:\t%q (%s)\n", f.Image.Title, f.Image.URL)
+		if f.Image != nil {
+			fmt.Fprintf(w, "\xff\t\xffImage:\t%q (%s)\n", f.Image.Title, f.Image.URL)
+		}
 		fmt.Fprintf(w, "\xff\t\xffRefresh:\t%s\n", f.Refresh.Format(DATE))
 		fmt.Fprintf(w, "\xff\t\xffUnread:\t%d\n", f.Unread)
 		fmt.Fprintf(w, "\xff\t\xffItems:\t(%d) {\n", len(f.Items))
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-	"sort"
-	"strings"
 	"time"
 )
 
@@ -30,32 +28,14 @@ func parseRSS1(data []byte) (*Feed, error) {
 	out.Description = channel.Description
 	out.Link = channel.Link
 	out.Image = channel.Image.Image()
+	out.Refresh = time.Now().Add(DefaultRefreshInterval)
 	if channel.MinsToLive != 0 {
-		sort.Ints(channel.SkipHours)
-		next := time.Now().Add(time.Duration(channel.MinsToLive) * time.Minute)
-		for _, hour := range channel.SkipHours {
-			if hour == next.Hour() {
-				next = next.Add(time.Duration(60-next.Minute()) * time.Minute)
-			}
-		}
-		trying := true
-		for trying {
-			trying = false
-			for _, day := range channel.SkipDays {
-				if strings.Title(day) == next.Weekday().String() {
-					next = next.Add(time.Duration(24-next.Hour()) * time.Hour)
-					trying = true
-					break
-				}
-			}
-		}
-
-		out.Refresh = next
-	}
-
-	if out.Refresh.IsZero() {
-		out.Refresh = time.Now().Add(DefaultRefreshInterval)
+		out.TTL = time.Duration(channel.MinsToLive) * time.Minute
+		out.Refresh = time.Now().Add(out.TTL)
 	}
+	out.SkipHours = channel.SkipHours
+	out.SkipDays = channel.SkipDays
+	out.Refresh = out.Skip(out.Refresh)
 
 	out.Items = make([]*Item, 0, len(feed.Items))
 	out.ItemMap = make(map[string]struct{})
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseItemLen(t *testing.T) {
@@ -174,3 +175,28 @@ func assertEqual(expected, got string, t *testing.T) {
 		t.Errorf("expect '%s', got '%s'", expected, got)
 	}
 }
+
+func TestParseTTL(t *testing.T) {
+	tests := map[string]time.Duration{
+		"rss_2.0":             1800 * time.Minute,
+		"rss_2.0-1_enclosure": 60 * time.Minute,
+		"rss_2.0-1":           0,
+	}
+
+	for test, want := range tests {
+		name := filepath.Join("testdata", test)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Reading %s: %v", name, err)
+		}
+
+		feed, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parsing %s: %v", name, err)
+		}
+
+		if feed.TTL != want {
+			t.Errorf("%s: got %s, want %s", name, feed.TTL, want)
+		}
+	}
+}
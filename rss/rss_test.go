@@ -3,12 +3,17 @@ package rss
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseTitle(t *testing.T) {
@@ -19,6 +24,8 @@ func TestParseTitle(t *testing.T) {
 		"rss_2.0-1":  "Liftoff News",
 		"atom_1.0":   "Titel des Weblogs",
 		"atom_1.0-1": "Golem.de",
+		"json_1.0":   "JSON Feed Weblog",
+		"json_1.1":   "JSON Feed Podcast",
 	}
 
 	for test, want := range tests {
@@ -45,6 +52,7 @@ func TestEnclosure(t *testing.T) {
 		"rss_2.0":   Enclosure{URL: "http://example.com/file.mp3", Type: "audio/mpeg", Length: 65535},
 		"rss_2.0-1": Enclosure{URL: "http://gdb.voanews.com/6C49CA6D-C18D-414D-8A51-2B7042A81010_cx0_cy29_cw0_w800_h450.jpg", Type: "image/jpeg", Length: 3123},
 		"atom_1.0":  Enclosure{URL: "http://example.org/audio.mp3", Type: "audio/mpeg", Length: 1234},
+		"json_1.1":  Enclosure{URL: "http://example.org/audio.mp3", Type: "audio/mpeg", Length: 1234},
 	}
 
 	for test, want := range tests {
@@ -158,3 +166,230 @@ func TestItemGUIDs(t *testing.T) {
 		t.Errorf("Expected two items in feed 'rssupdate' after step 2, got %v", len(feed2.Items))
 	}
 }
+
+func TestFeedConditionalUpdate(t *testing.T) {
+	fetch := func(url string) (resp *http.Response, err error) {
+		resp, err = MakeTestdataFetchFunc("rssupdate-1")(url)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header = http.Header{}
+		resp.Header.Set("ETag", `"v1"`)
+		resp.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return resp, nil
+	}
+	feed, err := FetchByFunc(fetch, "http://localhost/dummyrss")
+	if err != nil {
+		t.Fatalf("Failed fetching testdata 'rssupdate-1': %v", err)
+	}
+
+	if feed.ETag != `"v1"` || feed.LastModified != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("Expected validators to be kept, got ETag %q Last-Modified %q", feed.ETag, feed.LastModified)
+	}
+
+	notModified := func(url string) (resp *http.Response, err error) {
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+
+	feed.Refresh = time.Time{}
+	err = feed.UpdateByFunc(notModified)
+	if err != nil {
+		t.Fatalf("Expected a 304 to be a successful update, got %v", err)
+	}
+
+	if len(feed.Items) != 1 {
+		t.Errorf("Expected items to be untouched by a 304, got %v", len(feed.Items))
+	}
+
+	if !feed.Refresh.After(time.Now()) {
+		t.Errorf("Expected a 304 to push the next refresh out, got %v", feed.Refresh)
+	}
+
+	if _, err := FetchByFunc(notModified, "http://localhost/dummyrss"); !errors.Is(err, ErrNotModified) {
+		t.Errorf("Expected ErrNotModified from FetchByFunc, got %v", err)
+	}
+}
+
+func TestParseFormatDetection(t *testing.T) {
+	// each of these feeds embeds another format's markup in its
+	// content, which used to trip up substring based detection.
+	tests := map[string]string{
+		"atom_1.0_embedded_rss": "Feeds Explained",
+		"rss_1.0_embedded_rss":  "Syndication Notes",
+		"rss_2.0_embedded_atom": "Atom Notes",
+		"json_1.1_embedded_rss": "JSON Feed Notes",
+	}
+
+	for test, want := range tests {
+		name := filepath.Join("testdata", test)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Reading %s: %v", name, err)
+		}
+
+		feed, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parsing %s: %v", name, err)
+		}
+
+		if feed.Title != want {
+			t.Errorf("%s: got %q, want %q", name, feed.Title, want)
+		}
+		if len(feed.Items) != 1 {
+			t.Errorf("%s: got %d items, want 1", name, len(feed.Items))
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"html_with_feed_links": "unrecognized feed format: root element <html>",
+		"test1":                "unrecognized feed format: no root element found",
+	}
+
+	for test, want := range tests {
+		name := filepath.Join("testdata", test)
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Reading %s: %v", name, err)
+		}
+
+		_, err = Parse(data)
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %q", name, err, want)
+		}
+	}
+
+	// parse failures name the detected format
+	_, err := Parse([]byte(`<rss version="2.0"></rss>`))
+	if err == nil || !strings.HasPrefix(err.Error(), "parsing as RSS 2.0: ") {
+		t.Errorf("got error %v, want it to mention RSS 2.0", err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	// a saturday, 10:30 utc
+	at := time.Date(2024, 6, 1, 10, 30, 0, 0, time.UTC)
+	tests := map[string]struct {
+		feed Feed
+		want time.Time
+	}{
+		"no rules":    {Feed{}, at},
+		"not skipped": {Feed{SkipHours: []int{3}}, at},
+		"skipped hours": {
+			Feed{SkipHours: []int{10, 11}},
+			time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		"skipped days": {
+			Feed{SkipDays: []string{"saturday", " Sunday"}},
+			time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC),
+		},
+		"the whole week": {
+			Feed{SkipDays: []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}},
+			at,
+		},
+	}
+	for name, test := range tests {
+		if got := test.feed.Skip(at); !got.Equal(test.want) {
+			t.Errorf("%s: expected %s, got %s", name, test.want, got)
+		}
+	}
+}
+
+func TestSkipHoursWithoutTTL(t *testing.T) {
+	allowed := (time.Now().UTC().Hour() + 5) % 24
+	var hours string
+	for h := 0; h < 24; h++ {
+		if h != allowed {
+			hours += fmt.Sprintf("<hour>%d</hour>", h)
+		}
+	}
+	feed, err := Parse([]byte(`<rss version="2.0"><channel><title>t</title>
+		<skipHours>` + hours + `</skipHours><skipDays><day>Monday</day></skipDays>
+		</channel></rss>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.TTL != 0 || len(feed.SkipHours) != 23 || len(feed.SkipDays) != 1 {
+		t.Fatalf("unexpected ttl %s & skip rules %v %v", feed.TTL, feed.SkipHours, feed.SkipDays)
+	}
+	if feed.Refresh.UTC().Hour() != allowed || feed.Refresh.UTC().Weekday() == time.Monday {
+		t.Errorf("expected the refresh in hour %d & not on a monday, got %s", allowed, feed.Refresh.UTC())
+	}
+}
+
+// fetchItems serves a feed of the given items, in the given
+// order. each item is published id days into 2024.
+func fetchItems(ids ...int) FetchFunc {
+	return func(url string) (*http.Response, error) {
+		body := `<rss version="2.0"><channel><title>t</title><ttl>-1</ttl>`
+		for _, id := range ids {
+			date := time.Date(2024, 1, 1+id, 0, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			body += fmt.Sprintf("<item><guid>%d</guid><title>%d</title><pubDate>%s</pubDate></item>", id, id, date)
+		}
+		body += `</channel></rss>`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+}
+
+func itemIDs(f *Feed) (out []string) {
+	for _, item := range f.Items {
+		out = append(out, item.ID)
+	}
+	return out
+}
+
+func TestTrimItems(t *testing.T) {
+	defer func(n int) { MaxItems = n }(MaxItems)
+	MaxItems = 3
+	ids := itemIDs
+
+	feed, err := FetchByFunc(fetchItems(1, 2), "http://localhost/dummyrss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range [][]int{{3}, {4, 5}} {
+		err = feed.UpdateByFunc(fetchItems(update...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := ids(feed); !slices.Equal(got, []string{"3", "4", "5"}) {
+		t.Errorf("expected the oldest items to be dropped, got %v", got)
+	}
+	if _, ok := feed.ItemMap["1"]; ok {
+		t.Error("expected dropped items to be forgotten by ItemMap")
+	}
+
+	// items still in the feed are kept, even past MaxItems
+	err = feed.UpdateByFunc(fetchItems(2, 3, 4, 5, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(feed); !slices.Equal(got, []string{"3", "4", "5", "2", "6"}) {
+		t.Errorf("expected every item in the feed to be kept, got %v", got)
+	}
+}
+
+func TestTrimItemsNewestFirst(t *testing.T) {
+	defer func(n int) { MaxItems = n }(MaxItems)
+	MaxItems = 4
+
+	feed, err := FetchByFunc(fetchItems(5, 4, 3, 2, 1), "http://localhost/dummyrss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = feed.UpdateByFunc(fetchItems(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemIDs(feed); !slices.Equal(got, []string{"5", "4", "3", "6"}) {
+		t.Errorf("expected the two oldest items to be dropped, got %v", got)
+	}
+}
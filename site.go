@@ -12,17 +12,20 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"git.j3s.sh/vore/archive"
+	"git.j3s.sh/vore/discover"
 	"git.j3s.sh/vore/favicon"
 	"git.j3s.sh/vore/lib"
 	"git.j3s.sh/vore/reaper"
 	"git.j3s.sh/vore/rss"
 	"git.j3s.sh/vore/sqlite"
-	"git.j3s.sh/vore/wayback"
 	"golang.org/x/crypto/bcrypt"
-	nethtml "golang.org/x/net/html"
 )
 
 type Site struct {
@@ -37,14 +40,39 @@ type Site struct {
 
 	// favicon fetcher for caching favicons
 	faviconFetcher *favicon.FaviconFetcher
+
+	// where saved items are archived, in order of preference
+	archivers []archive.Archiver
+	// archives saves in the background
+	archiveQueue *archive.Queue
+	// local page snapshots, served at /archive/{id}
+	snapshots *archive.Local
+
+	// background work that Shutdown waits for
+	background sync.WaitGroup
+}
+
+// Config holds everything an operator can tune.
+// see main for the flags that set it.
+type Config struct {
+	Reaper reaper.Config
+	// Archivers are the names of the archivers that saves go
+	// to, in order. see archive.New.
+	Archivers []string
+	// SnapshotWARC keeps a warc of each local snapshot too
+	SnapshotWARC bool
+	// WaybackKeys is a file holding archive.org api keys, as
+	// "access:secret". without it, captures are anonymous.
+	WaybackKeys string
 }
 
 type Save struct {
 	// inferred: user_id
 }
 
-// New returns a fully populated & ready for action Site
-func New() *Site {
+// New returns a fully populated & ready for action Site. all
+// background work stops once ctx is done; see Shutdown.
+func New(ctx context.Context, cfg Config) (*Site, error) {
 	err := os.MkdirAll("data", 0700)
 	if err != nil {
 		panic(err)
@@ -55,25 +83,116 @@ func New() *Site {
 	// - busy_timeout=5000: locky locky 5 secs
 	// - synchronous=NORMAL: "The synchronous=NORMAL setting is a good choice for most applications running in WAL mode."
 	// - cache_size=-64000: 64MB ram for db cache (yum yum more perf)
-	db := sqlite.New("data/vore.db?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_pragma=cache_size(-64000)")
+	db, err := sqlite.New("data/vore.db?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_pragma=cache_size(-64000)")
+	if err != nil {
+		return nil, err
+	}
+	feedReaper, err := reaper.New(ctx, db, cfg.Reaper)
+	if err != nil {
+		return nil, err
+	}
+
+	// snapshots are always served, even if the local archiver
+	// has since been turned off
+	snapshots := &archive.Local{
+		Dir:  filepath.Join("data", "snapshots"),
+		WARC: cfg.SnapshotWARC,
+	}
+	wb := &archive.Wayback{}
+	if cfg.WaybackKeys != "" {
+		wb.Client.AccessKey, wb.Client.SecretKey, err = readWaybackKeys(cfg.WaybackKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	archivers, err := archive.New(cfg.Archivers, snapshots, wb)
+	if err != nil {
+		return nil, err
+	}
 
 	// init favicon fetcher
-	faviconFetcher := favicon.NewFaviconFetcher()
-	s := Site{
+	faviconFetcher := favicon.NewFaviconFetcher(ctx)
+	s := &Site{
 		title:          "vore",
-		reaper:         reaper.New(db),
+		reaper:         feedReaper,
 		db:             db,
 		faviconFetcher: faviconFetcher,
+		archivers:      archivers,
+		archiveQueue:   archive.NewQueue(db, archivers),
+		snapshots:      snapshots,
 	}
 
 	// favi fetchy - every day or so
+	s.background.Add(1)
 	go func() {
+		defer s.background.Done()
 		log.Println("favicon: starting favicon fetch for all feed domains")
-		feedURLs := db.GetAllFeedURLs()
+		feedURLs, err := db.GetAllFeedURLs()
+		if err != nil {
+			log.Printf("favicon: could not list feeds: %s\n", err)
+			return
+		}
 		faviconFetcher.FetchFaviconsForDomains(feedURLs)
 	}()
 
-	return &s
+	for i, a := range archivers {
+		if a.Name() == archive.NameLocal {
+			// snapshot the saves from before local was turned on
+			n, err := db.QueueMissingArchiveJobs(archive.NameLocal, i)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				log.Printf("archive: queued %d saves for local snapshots\n", n)
+			}
+		}
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.archiveQueue.Run(ctx)
+	}()
+
+	return s, nil
+}
+
+// readWaybackKeys reads archive.org api keys from a file, as
+// "access:secret". they're kept out of the command line, where
+// anyone on the machine could read them.
+func readWaybackKeys(path string) (string, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	access, secret, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+	if !ok || access == "" || secret == "" {
+		return "", "", fmt.Errorf("%s: expected wayback keys as access:secret", path)
+	}
+	return access, secret, nil
+}
+
+// Shutdown waits for the site's background work to wrap up after
+// the context passed to New is done, then closes the database.
+// if ctx is done first, the database is closed regardless, which
+// still lets any queries that are under way finish.
+func (s *Site) Shutdown(ctx context.Context) error {
+	err := s.reaper.Wait(ctx)
+	if err != nil {
+		log.Printf("site: gave up waiting for the reaper: %s\n", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("site: gave up waiting for background work: %s\n", ctx.Err())
+	}
+
+	return s.db.Close()
 }
 
 func (s *Site) staticHandler(w http.ResponseWriter, r *http.Request) {
@@ -86,8 +205,12 @@ func (s *Site) staticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Site) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if s.loggedIn(r) {
-		username := s.username(r)
+	username, err := s.username(r)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	if username != "" {
 		http.Redirect(w, r, "/"+username, http.StatusSeeOther)
 		return
 	}
@@ -100,8 +223,12 @@ func (s *Site) discoverHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *Site) loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		if s.loggedIn(r) {
-			username := s.username(r)
+		username, err := s.username(r)
+		if err != nil {
+			s.renderDBErr(w, err)
+			return
+		}
+		if username != "" {
 			http.Redirect(w, r, "/"+username, http.StatusSeeOther)
 		} else {
 			s.renderPage(w, r, "login", nil)
@@ -112,10 +239,14 @@ func (s *Site) loginHandler(w http.ResponseWriter, r *http.Request) {
 		password := r.FormValue("password")
 
 		err := s.login(w, username, password)
-		if err != nil {
+		if errors.Is(err, errLoginFailed) {
 			s.renderErr(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
+		if err != nil {
+			s.renderDBErr(w, err)
+			return
+		}
 		http.Redirect(w, r, "/"+username, http.StatusSeeOther)
 	}
 }
@@ -133,27 +264,31 @@ func (s *Site) registerHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 	err := s.register(username, password)
+	if errors.Is(err, errRegisterFailed) {
+		s.renderErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		s.renderErr(w, err.Error(), http.StatusInternalServerError)
+		s.renderDBErr(w, err)
 		return
 	}
 	err = s.login(w, username, password)
 	if err != nil {
-		s.renderErr(w, err.Error(), http.StatusInternalServerError)
+		s.renderDBErr(w, err)
 		return
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// saveHandler is an endpoint that takes a url, archives it
-// via archive.org, and then saves it to the user's account.
+// saveHandler is an endpoint that takes a url & saves it to the
+// user's account straight away. it's archived in the background,
+// and the archive page shows how that's going.
 func (s *Site) saveHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.loggedIn(r) {
-		s.renderErr(w, "", http.StatusUnauthorized)
+	username, ok := s.requireLogin(w, r)
+	if !ok {
 		return
 	}
 
-	username := s.username(r)
 	encodedURL := r.PathValue("url")
 	decodedURL, err := url.QueryUnescape(encodedURL)
 	if err != nil {
@@ -162,136 +297,570 @@ func (s *Site) saveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	item, err := s.reaper.GetItem(decodedURL)
+	feed, item, err := s.reaper.GetItemFeed(decodedURL)
 	if err != nil {
-		fmt.Fprintf(w, "error!")
+		s.renderErr(w, "no such item", http.StatusNotFound)
 		return
 	}
 
-	c := wayback.Client{}
-
-	archiveURL, err := c.Archive(context.Background(), decodedURL)
+	var archivers []string
+	for _, a := range s.archivers {
+		archivers = append(archivers, a.Name())
+	}
+	// the whole post is kept, so that the save outlives it
+	// dropping out of its feed
+	_, err = s.db.QueueSavedItem(username, sqlite.SavedItem{
+		ItemTitle: item.Title,
+		ItemURL:   item.Link,
+		Item:      item,
+		FeedURL:   feed.UpdateURL,
+		FeedTitle: feed.Title,
+		FeedLink:  feed.Link,
+	}, archivers)
 	if err != nil {
-		log.Println(err)
-		fmt.Fprintf(w, "error capturing archive!!")
+		s.renderDBErr(w, err)
+		return
+	}
+	s.archiveQueue.Wake()
+	if isFetch(r) {
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
+	// a plain form goes back to the page it was on
+	back := "/archive"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+		back = ref.Path
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
 
-	err = s.db.WriteSavedItem(username, sqlite.SavedItem{
-		ArchiveURL: archiveURL,
-		ItemTitle:  item.Title,
-		ItemURL:    item.Link,
-	})
+// isFetch reports whether r was made by javascript, rather than by
+// the browser navigating, going by the Sec-Fetch-Mode header.
+func isFetch(r *http.Request) bool {
+	mode := r.Header.Get("Sec-Fetch-Mode")
+	return mode != "" && mode != "navigate"
+}
+
+// snapshotHandler serves a page archived by the local archiver,
+// or its warc.
+func (s *Site) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id, warc := strings.CutSuffix(r.PathValue("id"), ".warc")
+	open := s.snapshots.Open
+	if warc {
+		open = s.snapshots.OpenWARC
+	}
+	f, err := open(id)
+	if errors.Is(err, archive.ErrNoSnapshot) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
-		log.Println(err)
-		fmt.Fprintf(w, "error!!!")
+		s.renderErr(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer f.Close()
+
+	if warc {
+		w.Header().Set("Content-Type", "application/warc")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.warc"`)
+	}
+	// snapshots are someone else's html on our domain, so they
+	// mustn't be able to run scripts or read cookies
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	// snapshots never change, since they're named after their
+	// contents
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Time{}, f)
 }
 
 func (s *Site) userHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.PathValue("username")
 
-	if !s.db.UserExists(username) {
+	exists, err := s.db.UserExists(username)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	if !exists {
 		http.NotFound(w, r)
 		return
 	}
 
-	items := s.reaper.TrimFuturePosts(s.reaper.SortFeedItemsByDate(s.reaper.GetUserFeeds(username)))
+	feeds, err := s.reaper.GetUserFeeds(username)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	items := s.reaper.TrimFuturePosts(s.reaper.SortFeedItemsByDate(feeds))
 
-	var readItems map[string]bool
-	if s.loggedIn(r) {
-		readItems = s.db.GetUserReadItems(s.username(r))
+	viewer, err := s.username(r)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	var readItems, savedItems map[string]bool
+	if viewer != "" {
+		readItems, err = s.db.GetUserReadItems(viewer)
+		if err != nil {
+			s.renderDBErr(w, err)
+			return
+		}
+		savedItems, err = s.db.GetUserSavedURLs(viewer)
+		if err != nil {
+			s.renderDBErr(w, err)
+			return
+		}
 	}
 
 	data := struct {
-		User      string
-		Items     []*rss.Item
-		ReadItems map[string]bool
+		User       string
+		Items      []*rss.Item
+		ReadItems  map[string]bool
+		SavedItems map[string]bool
 	}{
-		User:      username,
-		Items:     items,
-		ReadItems: readItems,
+		User:       username,
+		Items:      items,
+		ReadItems:  readItems,
+		SavedItems: savedItems,
 	}
 
 	s.renderPage(w, r, "user", data)
 }
 
 func (s *Site) userSavesHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.loggedIn(r) {
-		s.renderErr(w, "", http.StatusUnauthorized)
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	saves, err := s.db.GetUserSavedItems(username)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	// set after a deletion, so that it can be undone
+	deleted, _ := strconv.Atoi(r.URL.Query().Get("deleted"))
+
+	data := struct {
+		Saves   []sqlite.SavedItem
+		Deleted int
+	}{
+		Saves:   saves,
+		Deleted: deleted,
+	}
+	s.renderPage(w, r, "archive", data)
+}
+
+// maxNoteLength bounds the note on a save.
+const maxNoteLength = 10000
+
+// savedItemID returns the {id} of a save from the request path.
+// if it isn't a number, it renders a 404 & returns false.
+func (s *Site) savedItemID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.renderErr(w, "no such save", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// deleteSaveHandler hides one of the user's saves. the archive page
+// that it redirects to offers to undo it.
+func (s *Site) deleteSaveHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+	id, ok := s.savedItemID(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.db.DeleteSavedItem(username, id)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/archive?deleted=%d", id), http.StatusSeeOther)
+}
+
+// restoreSaveHandler brings back a deleted save.
+func (s *Site) restoreSaveHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+	id, ok := s.savedItemID(w, r)
+	if !ok {
 		return
 	}
 
-	username := s.username(r)
-	saves := s.db.GetUserSavedItems(username)
-	s.renderPage(w, r, "archive", saves)
+	err := s.db.RestoreSavedItem(username, id)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/archive#save-%d", id), http.StatusSeeOther)
+}
+
+// saveNoteHandler sets the user's note on one of their saves. an
+// empty note removes it.
+func (s *Site) saveNoteHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+	id, ok := s.savedItemID(w, r)
+	if !ok {
+		return
+	}
+	note := strings.TrimSpace(r.FormValue("note"))
+	if utf8.RuneCountInString(note) > maxNoteLength {
+		e := fmt.Sprintf("notes can be at most %d characters", maxNoteLength)
+		s.renderErr(w, e, http.StatusBadRequest)
+		return
+	}
+
+	err := s.db.SetSavedItemNote(username, id, note)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/archive#save-%d", id), http.StatusSeeOther)
 }
 
 func (s *Site) settingsHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.loggedIn(r) {
-		s.renderErr(w, "", http.StatusUnauthorized)
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	s.renderFeeds(w, r, username, nil)
+}
+
+// renderFeeds renders the feeds page. failed feeds are listed with
+// what went wrong, & put back in the textarea under the user's
+// feeds, so that they can be fixed.
+func (s *Site) renderFeeds(w http.ResponseWriter, r *http.Request, username string, failed []feedChange) {
+	feeds, err := s.reaper.GetUserFeeds(username)
+	if err != nil {
+		s.renderDBErr(w, err)
 		return
 	}
+	s.renderPage(w, r, "feeds", struct {
+		Feeds  []*rss.Feed
+		Failed []feedChange
+	}{feeds, failed})
+}
 
-	var feeds []*rss.Feed
-	feeds = s.reaper.GetUserFeeds(s.username(r))
-	s.renderPage(w, r, "feeds", feeds)
+// feedChange is a feed that a subscription plan would add, or
+// that failed validation.
+type feedChange struct {
+	URL   string
+	Title string
+	Items int
+	// Known is set when vore already had the feed, so it
+	// wasn't fetched again
+	Known bool
+	// From is the website that the user gave, when URL is the
+	// feed it advertises
+	From string
+	// Choices are the feeds advertised by a website that has
+	// more than one, for the user to pick from
+	Choices []string
+	Err     string
+
+	// feed is what was fetched to check the feed, so that it
+	// doesn't need fetching again to subscribe to it. it's nil
+	// when the feed is Known.
+	feed *rss.Feed
 }
 
-// TODO: show diff before submission (like tf plan)
-// check if feed exists in db already?
-// validate that title exists
+// subscriptionPlan is what submitting the feeds textarea would
+// do, shown to the user before anything changes (like tf plan).
+type subscriptionPlan struct {
+	// Input is the textarea as submitted, so it can be edited
+	Input     string
+	Added     []feedChange
+	Removed   []string
+	Invalid   []feedChange
+	Choices   []feedChange
+	Unchanged []string
+	// URLs is the full list of feeds to subscribe to on
+	// confirmation: everything that's valid
+	URLs []string
+}
+
+func (p subscriptionPlan) HasChanges() bool {
+	return len(p.Added) > 0 || len(p.Removed) > 0 || len(p.Choices) > 0
+}
+
+// settingsSubmitHandler validates the feeds textarea & shows what
+// would change. nothing is subscribed until the plan is confirmed
+// by settingsConfirmHandler.
+// TODO: validate that title exists
 func (s *Site) settingsSubmitHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.loggedIn(r) {
-		s.renderErr(w, "", http.StatusUnauthorized)
+	username, ok := s.requireLogin(w, r)
+	if !ok {
 		return
 	}
 
-	// validate user input
-	var validatedURLs []string
-	for _, inputURL := range strings.Split(r.FormValue("submit"), "\r\n") {
+	current, err := s.db.GetUserFeedURLs(username)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	subscribed := make(map[string]bool)
+	for _, u := range current {
+		subscribed[u] = true
+	}
+
+	input := r.FormValue("submit")
+	plan := subscriptionPlan{Input: input}
+	seen := make(map[string]bool)
+	var newURLs []string
+	for _, inputURL := range strings.Split(input, "\n") {
 		inputURL = strings.TrimSpace(inputURL)
-		if inputURL == "" {
+		if inputURL == "" || seen[inputURL] {
 			continue
 		}
+		seen[inputURL] = true
 
-		// if the entry is already in reaper, don't validate
-		if s.reaper.HasFeed(inputURL) {
-			validatedURLs = append(validatedURLs, inputURL)
+		if subscribed[inputURL] {
+			plan.Unchanged = append(plan.Unchanged, inputURL)
+			plan.URLs = append(plan.URLs, inputURL)
 			continue
 		}
-		if _, err := url.ParseRequestURI(inputURL); err != nil {
-			e := fmt.Sprintf("can't parse url '%s': %s", inputURL, err)
-			s.renderErr(w, e, http.StatusBadRequest)
-			return
+		newURLs = append(newURLs, inputURL)
+	}
+	for _, change := range s.validateFeeds(r.Context(), newURLs) {
+		switch {
+		case change.Err != "":
+			plan.Invalid = append(plan.Invalid, change)
+		case len(change.Choices) > 0:
+			plan.Choices = append(plan.Choices, change)
+		case change.From != "" && seen[change.URL]:
+			// a website whose feed is already on the list
+		case change.From != "" && subscribed[change.URL]:
+			seen[change.URL] = true
+			plan.Unchanged = append(plan.Unchanged, change.URL)
+			plan.URLs = append(plan.URLs, change.URL)
+		default:
+			seen[change.URL] = true
+			plan.Added = append(plan.Added, change)
+			plan.URLs = append(plan.URLs, change.URL)
+		}
+	}
+	for _, u := range current {
+		if !seen[u] {
+			plan.Removed = append(plan.Removed, u)
 		}
-		validatedURLs = append(validatedURLs, inputURL)
 	}
 
-	// write to reaper + db
-	for _, u := range validatedURLs {
-		// if it's in reaper, it's in the db, safe to skip
+	s.renderPage(w, r, "feedsPreview", plan)
+}
+
+// how many new feeds the feeds page fetches at once, & how long
+// it waits for all of them.
+const (
+	validateConcurrency = 8
+	validateTimeout     = 15 * time.Second
+)
+
+// validateFeeds runs validateFeed on each of urls in parallel,
+// returning the results in the same order. anything that hasn't
+// finished within validateTimeout is reported as timed out.
+func (s *Site) validateFeeds(ctx context.Context, urls []string) []feedChange {
+	ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+
+	changes := make([]feedChange, len(urls))
+	for i, u := range urls {
+		changes[i] = feedChange{URL: u, Err: "timed out"}
+	}
+
+	type result struct {
+		i      int
+		change feedChange
+	}
+	results := make(chan result, len(urls))
+	sem := make(chan struct{}, validateConcurrency)
+	// these belong to the request rather than to the site, so
+	// they aren't tracked in s.background: they all give up once
+	// ctx is done, & results has room for every one of them
+	for i, u := range urls {
+		go func() {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+			results <- result{i, s.validateFeed(ctx, u)}
+		}()
+	}
+
+	for range urls {
+		select {
+		case res := <-results:
+			changes[res.i] = res.change
+		case <-ctx.Done():
+			return changes
+		}
+	}
+	return changes
+}
+
+// validateFeed checks that u is a url that vore can fetch a feed
+// from. feeds that vore already has aren't fetched again, & new
+// feeds are only previewed: nothing is kept until someone
+// subscribes. if u is a website rather than a feed, the feeds it
+// advertises are used instead: one is substituted for u, &
+// several are offered as Choices.
+func (s *Site) validateFeed(ctx context.Context, u string) feedChange {
+	change := feedChange{URL: u}
+	if _, err := url.ParseRequestURI(u); err != nil && !s.reaper.HasFeed(u) {
+		change.Err = fmt.Sprintf("can't parse url: %s", err)
+		return change
+	}
+	err := s.preview(ctx, &change)
+	if err != nil {
+		feeds, derr := discover.Fetch(ctx, http.DefaultClient, u)
+		if derr != nil || len(feeds) == 0 {
+			change.Err = fmt.Sprintf("can't fetch: %s", err)
+			return change
+		}
+		if len(feeds) > 1 {
+			change.Choices = feeds
+			return change
+		}
+
+		found := feedChange{URL: feeds[0], From: u}
+		err = s.preview(ctx, &found)
+		if err != nil {
+			change.Err = fmt.Sprintf("found the feed %s, but can't fetch it: %s", feeds[0], err)
+			return change
+		}
+		change = found
+	}
+	return change
+}
+
+// preview fills in change's title & post count, from vore's copy
+// of the feed if it has one, & by fetching it otherwise.
+func (s *Site) preview(ctx context.Context, change *feedChange) error {
+	f := s.reaper.GetFeed(change.URL)
+	if f != nil {
+		change.Known = true
+	} else {
+		var err error
+		f, err = s.reaper.Preview(ctx, change.URL)
+		if err != nil {
+			return err
+		}
+		change.feed = f
+	}
+	change.Title = f.Title
+	change.Items = len(f.Items)
+	return nil
+}
+
+// addFeeds adds urls to the reaper, once they've been subscribed
+// to: that's the only way a feed gets into vore. feeds that were
+// fetched to check them are handed over as they are, & the rest
+// are fetched, since a feed that was orphaned can be reaped
+// between being checked & being subscribed to. feeds that can't
+// be fetched are logged, & are picked up again when the reaper
+// restarts.
+func (s *Site) addFeeds(ctx context.Context, urls []string, checked []feedChange) {
+	fetched := make(map[string]*rss.Feed)
+	for _, change := range checked {
+		if change.feed != nil {
+			fetched[change.URL] = change.feed
+		}
+	}
+	for _, u := range urls {
 		if s.reaper.HasFeed(u) {
 			continue
 		}
-		err := s.reaper.Fetch(u)
+		if f, ok := fetched[u]; ok {
+			s.reaper.AddFeed(f)
+			continue
+		}
+		err := s.reaper.FetchContext(ctx, u)
 		if err != nil {
-			e := fmt.Sprintf("reaper: can't fetch '%s' %s", u, err)
-			s.renderErr(w, e, http.StatusBadRequest)
-			return
+			log.Printf("site: could not fetch %s after subscribing to it: %s\n", u, err)
 		}
-		s.db.WriteFeed(u)
 	}
+}
 
-	err := s.db.BatchSubscribe(s.username(r), validatedURLs)
+// settingsConfirmHandler applies a subscription plan from
+// settingsSubmitHandler. the plan comes back as a plain form
+// with one url field per feed, so it needs no javascript. feeds
+// that failed validation come back as failed fields, & are
+// handed back to the user to fix, along with any that fail it
+// this time around.
+func (s *Site) settingsConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
 	if err != nil {
-		log.Println(err)
-		e := fmt.Sprintf("reaper: can't batchsubscribe user=%s err=%s", s.username(r), err)
-		s.renderErr(w, e, http.StatusInternalServerError)
+		s.renderErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// covers checking the new feeds & then adding them
+	ctx, cancel := context.WithTimeout(r.Context(), 2*validateTimeout)
+	defer cancel()
+
+	var failed []feedChange
+	for _, u := range r.PostForm["failed"] {
+		failed = append(failed, feedChange{URL: u})
+	}
+
+	// the form came from the user, so anything vore doesn't
+	// know about yet has to be validated again
+	var urls, unknown []string
+	for _, u := range r.PostForm["url"] {
+		if s.reaper.HasFeed(u) {
+			urls = append(urls, u)
+		} else {
+			unknown = append(unknown, u)
+		}
+	}
+	checked := s.validateFeeds(ctx, unknown)
+	for i, change := range checked {
+		switch {
+		case change.Err != "":
+			failed = append(failed, change)
+		case change.URL != unknown[i] || len(change.Choices) > 0:
+			failed = append(failed, feedChange{URL: unknown[i], Err: "this is a website, not a feed"})
+		default:
+			urls = append(urls, change.URL)
+		}
+	}
+
+	for _, u := range urls {
+		err = s.db.WriteFeed(u)
+		if err != nil {
+			s.renderDBErr(w, err)
+			return
+		}
+	}
+	err = s.db.BatchSubscribe(username, urls)
+	if err != nil {
+		s.renderDBErr(w, fmt.Errorf("can't batchsubscribe user=%s: %w", username, err))
 		return
 	}
+	s.addFeeds(ctx, urls, checked)
 
+	if len(failed) > 0 {
+		s.renderFeeds(w, r, username, failed)
+		return
+	}
 	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
 }
 
@@ -303,163 +872,199 @@ func (s *Site) feedDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		s.renderErr(w, e, http.StatusBadRequest)
 		return
 	}
-	fetchErr, err := s.db.GetFeedFetchError(decodedURL)
+	fetchState, err := s.db.GetFeedFetchState(decodedURL)
 	if err != nil {
 		e := fmt.Sprintf("failed to fetch feed error '%s' %s", encodedURL, err)
 		s.renderErr(w, e, http.StatusBadRequest)
 		return
 	}
 
+	attempts, err := s.db.GetFetchAttempts(decodedURL, 50)
+	if err != nil {
+		e := fmt.Sprintf("failed to get fetch history '%s' %s", encodedURL, err)
+		s.renderErr(w, e, http.StatusInternalServerError)
+		return
+	}
+	fetchStats, err := s.db.GetFetchStats(decodedURL)
+	if err != nil {
+		e := fmt.Sprintf("failed to get fetch stats '%s' %s", encodedURL, err)
+		s.renderErr(w, e, http.StatusInternalServerError)
+		return
+	}
+
+	refreshPlan, _ := s.reaper.GetRefreshPlan(decodedURL)
+
 	feedData := struct {
-		Feed         *rss.Feed
-		FetchFailure string
+		Feed        *rss.Feed
+		FetchState  sqlite.FeedFetchState
+		RefreshPlan reaper.RefreshPlan
+		Attempts    []sqlite.FetchAttempt
+		FetchStats  sqlite.FetchStats
 	}{
-		Feed:         s.reaper.GetFeed(decodedURL),
-		FetchFailure: fetchErr,
+		Feed:        s.reaper.GetFeed(decodedURL),
+		FetchState:  fetchState,
+		RefreshPlan: refreshPlan,
+		Attempts:    attempts,
+		FetchStats:  fetchStats,
 	}
 
 	s.renderPage(w, r, "feedDetails", feedData)
 }
 
+// fingerTimeout bounds how long /finger spends poking a website.
+const fingerTimeout = 10 * time.Second
+
+// fingerResult is a feed found by /finger.
+type fingerResult struct {
+	discover.Result
+	Subscribed bool
+}
+
+// fingerHandler pokes a website & lists the feeds that come out,
+// each with a button to subscribe. see discover.Find for where it
+// looks.
 func (s *Site) fingerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		s.renderPage(w, r, "finger", nil)
+		return
 	}
-	if r.Method == "POST" {
-		targetURL := r.FormValue("url")
-		if targetURL == "" {
-			http.Error(w, "Please provide a URL.", http.StatusBadRequest)
-			return
-		}
-
-		parsed, err := url.ParseRequestURI(targetURL)
-		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
-			http.Error(w, "Invalid URL (only http/https allowed).", http.StatusBadRequest)
-			return
-		}
 
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		defer cancel()
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
-		if err != nil {
-			http.Error(w, "failed to build request: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	targetURL := strings.TrimSpace(r.FormValue("url"))
+	if targetURL == "" {
+		s.renderErr(w, "please provide a url", http.StatusBadRequest)
+		return
+	}
+	parsed, err := url.ParseRequestURI(targetURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		s.renderErr(w, "invalid url (only http/https allowed)", http.StatusBadRequest)
+		return
+	}
 
-		resp, err := http.DefaultClient.Do(req)
+	username, err := s.username(r)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	subscribed := make(map[string]bool)
+	if username != "" {
+		urls, err := s.db.GetUserFeedURLs(username)
 		if err != nil {
-			http.Error(w, "failed to fetch URL: "+err.Error(), http.StatusBadGateway)
+			s.renderDBErr(w, err)
 			return
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			http.Error(w, "non-2xx status from site: "+resp.Status, http.StatusBadGateway)
-			return
+		for _, u := range urls {
+			subscribed[u] = true
 		}
+	}
 
-		doc, err := nethtml.Parse(resp.Body)
-		if err != nil {
-			http.Error(w, "failed to parse HTML: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	ctx, cancel := context.WithTimeout(r.Context(), fingerTimeout)
+	defer cancel()
+	found, err := discover.Find(ctx, http.DefaultClient, targetURL)
 
-		feeds := discoverFeeds(doc, parsed)
+	data := struct {
+		URL     string
+		Results []fingerResult
+		Err     error
+	}{URL: targetURL, Err: err}
+	for _, f := range found {
+		data.Results = append(data.Results, fingerResult{f, subscribed[f.URL]})
+	}
+	s.renderPage(w, r, "finger", data)
+}
 
-		// Display the results
-		fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="utf-8">
-    <title>%s feeds</title>
-</head>
-<body style="font-family:sans-serif;">`, html.EscapeString(targetURL))
+// subscribeHandler subscribes the user to a single feed. it's
+// behind the one-click buttons on /finger.
+func (s *Site) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.requireLogin(w, r)
+	if !ok {
+		return
+	}
 
-		if len(feeds) == 0 {
-			fmt.Fprintln(w, `<p><em>No RSS/Atom feeds found</em></p>`)
-		} else {
-			fmt.Fprintln(w, `<ul>`)
-			for _, f := range feeds {
-				fmt.Fprintf(w, `<li>%s</li>`, html.EscapeString(f))
-			}
-			fmt.Fprintln(w, `</ul>`)
-		}
-		fmt.Fprintln(w, `</body></html>`)
-	}
-}
-
-func discoverFeeds(doc *nethtml.Node, base *url.URL) []string {
-	var feeds []string
-	var f func(*nethtml.Node)
-	f = func(n *nethtml.Node) {
-		if n.Type == nethtml.ElementNode && n.Data == "link" {
-			var rel, typ, href string
-			for _, attr := range n.Attr {
-				switch attr.Key {
-				case "rel":
-					rel = attr.Val
-				case "type":
-					typ = attr.Val
-				case "href":
-					href = attr.Val
-				}
-			}
+	ctx, cancel := context.WithTimeout(r.Context(), validateTimeout)
+	defer cancel()
+	change := s.validateFeed(ctx, strings.TrimSpace(r.FormValue("url")))
+	if change.Err != "" {
+		e := fmt.Sprintf("'%s': %s", change.URL, change.Err)
+		s.renderErr(w, e, http.StatusBadRequest)
+		return
+	}
+	if len(change.Choices) > 0 {
+		e := fmt.Sprintf("'%s' has %d feeds, pick one on /finger", change.URL, len(change.Choices))
+		s.renderErr(w, e, http.StatusBadRequest)
+		return
+	}
 
-			if rel == "alternate" && (typ == "application/rss+xml" || typ == "application/atom+xml") {
-				// make href absolute if necessary
-				u, err := base.Parse(href)
-				if err == nil {
-					feeds = append(feeds, u.String())
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+	err := s.db.WriteFeed(change.URL)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+	err = s.db.Subscribe(username, change.URL)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
 	}
-	f(doc)
-	return feeds
+	s.addFeeds(ctx, []string{change.URL}, []feedChange{change})
+	http.Redirect(w, r, "/feeds/"+url.QueryEscape(change.URL), http.StatusSeeOther)
 }
 
 // username fetches a client's username based
 // on the sessionToken that user has set. username
 // will return "" if there is no sessionToken.
-func (s *Site) username(r *http.Request) string {
+func (s *Site) username(r *http.Request) (string, error) {
 	cookie, err := r.Cookie("session_token")
 	if err == http.ErrNoCookie {
-		return ""
+		return "", nil
 	}
 	if err != nil {
-		log.Println(err)
+		return "", err
 	}
-	username := s.db.GetUsernameBySessionToken(cookie.Value)
-	return username
+	return s.db.GetUsernameBySessionToken(cookie.Value)
 }
 
-func (s *Site) loggedIn(r *http.Request) bool {
-	if s.username(r) == "" {
-		return false
+// requireLogin returns the client's username. if they aren't
+// logged in (or we can't tell), it renders an error & returns
+// false, and the handler should bail.
+func (s *Site) requireLogin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, err := s.username(r)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return "", false
 	}
-	return true
+	if username == "" {
+		s.renderErr(w, "", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
 }
 
+// errLoginFailed is wrapped by login errors that are the
+// client's fault, as opposed to the database's.
+var errLoginFailed = errors.New("login failed")
+
 // login compares the sqlite password field against the user supplied password and
 // sets a session token against the supplied writer.
 func (s *Site) login(w http.ResponseWriter, username string, password string) error {
 	if username == "" {
-		return fmt.Errorf("username cannot be empty")
+		return fmt.Errorf("%w: username cannot be empty", errLoginFailed)
 	}
 	if password == "" {
-		return fmt.Errorf("password cannot be empty")
+		return fmt.Errorf("%w: password cannot be empty", errLoginFailed)
+	}
+	exists, err := s.db.UserExists(username)
+	if err != nil {
+		return err
 	}
-	if !s.db.UserExists(username) {
-		return fmt.Errorf("user '%s' does not exist", username)
+	if !exists {
+		return fmt.Errorf("%w: user '%s' does not exist", errLoginFailed, username)
 	}
-	storedPassword := s.db.GetPassword(username)
-	err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password))
+	storedPassword, err := s.db.GetPassword(username)
 	if err != nil {
-		return fmt.Errorf("invalid password")
+		return err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password))
+	if err != nil {
+		return fmt.Errorf("%w: invalid password", errLoginFailed)
 	}
 	sessionToken, err := s.db.GetSessionToken(username)
 	if err != nil {
@@ -480,9 +1085,24 @@ func (s *Site) login(w http.ResponseWriter, username string, password string) er
 	return nil
 }
 
+// errRegisterFailed is wrapped by registration errors that are
+// the client's fault. a username that's taken is reported with
+// sqlite.ErrExists instead.
+var errRegisterFailed = errors.New("registration failed")
+
 func (s *Site) register(username string, password string) error {
-	if s.db.UserExists(username) {
-		return fmt.Errorf("user '%s' already exists", username)
+	if username == "" {
+		return fmt.Errorf("%w: username cannot be empty", errRegisterFailed)
+	}
+	if password == "" {
+		return fmt.Errorf("%w: password cannot be empty", errRegisterFailed)
+	}
+	exists, err := s.db.UserExists(username)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("user '%s': %w", username, sqlite.ErrExists)
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -503,14 +1123,22 @@ func (s *Site) renderPage(w http.ResponseWriter, r *http.Request, page string, d
 	funcMap := template.FuncMap{
 		"printDomain":   s.printDomain,
 		"timeSince":     s.timeSince,
+		"timeUntil":     s.timeUntil,
 		"trimSpace":     strings.TrimSpace,
 		"escapeURL":     url.QueryEscape,
 		"faviconForURL": s.faviconForURL,
+		"plainText":     lib.PlainText,
 	}
 
 	tmplFiles := filepath.Join("files", "*.tmpl.html")
 	tmpl := template.Must(template.New("whatever").Funcs(funcMap).ParseGlob(tmplFiles))
 
+	username, err := s.username(r)
+	if err != nil {
+		s.renderDBErr(w, err)
+		return
+	}
+
 	// fields on this anon struct are generally
 	// pulled out of Data when they're globally required
 	// callers should jam anything they want into Data
@@ -522,13 +1150,13 @@ func (s *Site) renderPage(w http.ResponseWriter, r *http.Request, page string, d
 		Data       any
 	}{
 		Title:      page,
-		Username:   s.username(r),
-		LoggedIn:   s.loggedIn(r),
+		Username:   username,
+		LoggedIn:   username != "",
 		CutePhrase: s.randomCutePhrase(),
 		Data:       data,
 	}
 
-	err := tmpl.ExecuteTemplate(w, page, pageData)
+	err = tmpl.ExecuteTemplate(w, page, pageData)
 	if err != nil {
 		s.renderErr(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -597,6 +1225,16 @@ func (s *Site) timeSince(t time.Time) string {
 	}
 }
 
+// timeUntil is the forward-looking sibling of timeSince,
+// e.g. "in 2h30m"
+func (s *Site) timeUntil(t time.Time) string {
+	d := time.Until(t).Round(time.Minute)
+	if d <= 0 {
+		return "any moment now"
+	}
+	return "in " + strings.TrimSuffix(d.String(), "0s")
+}
+
 // renderErr sets the correct http status in the header,
 // optionally decorates certain errors, then renders the err page
 func (s *Site) renderErr(w http.ResponseWriter, error string, code int) {
@@ -606,6 +1244,11 @@ func (s *Site) renderErr(w http.ResponseWriter, error string, code int) {
 		prefix = "400 bad request\n"
 	case http.StatusUnauthorized:
 		prefix = "401 unauthorized\n"
+	case http.StatusNotFound:
+		prefix = "404 not found\n"
+	case http.StatusServiceUnavailable:
+		prefix = "503 service unavailable\n"
+		prefix += "vore is a little overwhelmed, try again in a moment\n\n"
 	case http.StatusInternalServerError:
 		prefix = "(╥﹏╥) oopsie woopsie, uwu\n"
 		prefix += "we made a fucky wucky (╥﹏╥)\n\n"
@@ -615,6 +1258,24 @@ func (s *Site) renderErr(w http.ResponseWriter, error string, code int) {
 	http.Error(w, prefix+error, code)
 }
 
+// renderDBErr renders an error that came out of the database
+// with a status to match: 404 for things that don't exist, 409
+// for things that already do, 503 if the database was too busy
+// to answer, and 500 otherwise.
+func (s *Site) renderDBErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sqlite.ErrNotFound):
+		s.renderErr(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, sqlite.ErrExists):
+		s.renderErr(w, err.Error(), http.StatusConflict)
+	case sqlite.IsBusy(err):
+		w.Header().Set("Retry-After", "5")
+		s.renderErr(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		s.renderErr(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Site) settingsRedirectHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/feeds", http.StatusMovedPermanently)
 }
@@ -628,12 +1289,11 @@ func (s *Site) savesRedirectHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Site) readHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.loggedIn(r) {
-		s.renderErr(w, "", http.StatusUnauthorized)
+	username, ok := s.requireLogin(w, r)
+	if !ok {
 		return
 	}
 
-	username := s.username(r)
 	encodedURL := r.PathValue("url")
 	decodedURL, err := url.QueryUnescape(encodedURL)
 	if err != nil {
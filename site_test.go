@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.j3s.sh/vore/archive"
+	"git.j3s.sh/vore/favicon"
+	"git.j3s.sh/vore/reaper"
+	"git.j3s.sh/vore/sqlite"
+)
+
+// newTestSite returns a site backed by a fresh db, with a user
+// called "reader" who is logged in with the session "token".
+func newTestSite(t *testing.T) (*Site, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vore.db")
+	db, err := sqlite.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r, err := reaper.New(ctx, db, reaper.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetSessionToken("reader", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Site{
+		title:          "vore",
+		reaper:         r,
+		db:             db,
+		faviconFetcher: favicon.NewFaviconFetcher(ctx),
+		archiveQueue:   archive.NewQueue(db, nil),
+	}, path
+}
+
+func serve(h http.HandlerFunc, method string, path string, pathValues ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: "token"})
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		req.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestHandlersSurviveDBFailures(t *testing.T) {
+	s, path := newTestSite(t)
+
+	rec := serve(s.userHandler, "GET", "/reader", "username", "reader")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a healthy db to serve a 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// break one table behind the site's back
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	_, err = raw.Exec("DROP TABLE read_item")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serve(s.userHandler, "GET", "/reader", "username", "reader")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected a 500 for a broken table, got %d: %s", rec.Code, rec.Body)
+	}
+	// failing to mark a post read shouldn't stop anyone reading it
+	rec = serve(s.readHandler, "GET", "/read/x", "url", "https://example.com/x")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect despite the broken table, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// then break everything
+	s.db.Close()
+	for name, h := range map[string]http.HandlerFunc{
+		"index":   s.indexHandler,
+		"archive": s.userSavesHandler,
+		"feeds":   s.settingsHandler,
+		"login":   s.loginHandler,
+	} {
+		rec = serve(h, "GET", "/")
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected a 500 for a closed db, got %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestRenderDBErr(t *testing.T) {
+	s := &Site{}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("user 'x': %w", sqlite.ErrNotFound), http.StatusNotFound},
+		{fmt.Errorf("user 'x': %w", sqlite.ErrExists), http.StatusConflict},
+		{sql.ErrConnDone, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.renderDBErr(rec, test.err)
+		if rec.Code != test.want {
+			t.Errorf("renderDBErr(%q) = %d, want %d", test.err, rec.Code, test.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s, _ := newTestSite(t)
+	tests := []struct {
+		username, password string
+		want               int
+	}{
+		{"newbie", "hunter2", http.StatusSeeOther},
+		{"reader", "hunter2", http.StatusConflict},
+		{"", "hunter2", http.StatusBadRequest},
+		{"nopassword", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := postForm(s.registerHandler, "/register", url.Values{
+			"username": {test.username},
+			"password": {test.password},
+		})
+		if rec.Code != test.want {
+			t.Errorf("registering %q with password %q: got %d, want %d: %s",
+				test.username, test.password, rec.Code, test.want, rec.Body)
+		}
+	}
+
+	// a race with another registration is a conflict too
+	err := s.db.AddUser("reader", "hunter2")
+	if !errors.Is(err, sqlite.ErrExists) {
+		t.Errorf("expected ErrExists for a taken username, got %v", err)
+	}
+}
+
+func postForm(h http.HandlerFunc, path string, form url.Values, pathValues ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: "token"})
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		req.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestSubscriptionPreview(t *testing.T) {
+	var addedFetches atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/added" {
+			addedFetches.Add(1)
+		}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>feed %s</title>
+			<item><guid>1</guid><link>http://example.com/1</link><title>post 1</title></item>
+			</channel></rss>`, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	s, _ := newTestSite(t)
+	old, kept, added := srv.URL+"/old", srv.URL+"/kept", srv.URL+"/added"
+	for _, u := range []string{old, kept} {
+		if err := s.db.WriteFeed(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.db.BatchSubscribe("reader", []string{old, kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	input := strings.Join([]string{kept, added, srv.URL + "/missing", "not a url"}, "\r\n")
+	rec := postForm(s.settingsSubmitHandler, "/feeds/submit", url.Values{"submit": {input}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a preview, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"+ " + added, `"feed /added", 1 posts`,
+		"- " + old,
+		"! " + srv.URL + "/missing", "! not a url",
+		"= " + kept,
+		`name="url" value="` + kept + `"`,
+		`name="url" value="` + added + `"`,
+		`name="failed" value="not a url"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the preview:\n%s", want, body)
+		}
+	}
+
+	// nothing changes until the plan is confirmed
+	subs, err := s.db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(subs)
+	if !slices.Equal(subs, []string{kept, old}) {
+		t.Fatalf("expected the preview to leave subscriptions alone, got %q", subs)
+	}
+	// or vore's feeds
+	if s.reaper.HasFeed(added) {
+		t.Fatal("expected the preview not to add the feed to the reaper")
+	}
+	all, err := s.db.GetAllFeedURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(all, added) {
+		t.Fatal("expected the preview not to add the feed to the db")
+	}
+
+	rec = postForm(s.settingsConfirmHandler, "/feeds/confirm", url.Values{
+		"url":    {kept, added},
+		"failed": {"not a url"},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the feeds page, got %d: %s", rec.Code, rec.Body)
+	}
+	// failures are handed back in the textarea
+	if !strings.Contains(rec.Body.String(), "\nnot a url\n</textarea>") {
+		t.Errorf("expected the failed url in the textarea:\n%s", rec.Body)
+	}
+	subs, err = s.db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(subs)
+	if !slices.Equal(subs, []string{added, kept}) {
+		t.Fatalf("unexpected subscriptions after confirming: %q", subs)
+	}
+	for _, u := range subs {
+		if !s.reaper.HasFeed(u) {
+			t.Errorf("expected %s to be fetched once it was subscribed to", u)
+		}
+	}
+	// once for the preview & once to check it again on confirming,
+	// which is what the reaper is given
+	if n := addedFetches.Load(); n != 2 {
+		t.Errorf("expected the new feed to be fetched twice, got %d", n)
+	}
+
+	// a confirmation can't sneak in a feed that doesn't work: it's
+	// handed back, & the rest of the plan goes ahead
+	rec = postForm(s.settingsConfirmHandler, "/feeds/confirm", url.Values{"url": {kept, srv.URL + "/missing"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the feeds page, got %d: %s", rec.Code, rec.Body)
+	}
+	body = rec.Body.String()
+	for _, want := range []string{
+		"! " + srv.URL + "/missing\n    can&#39;t fetch",
+		"\n" + srv.URL + "/missing\n</textarea>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on the feeds page:\n%s", want, body)
+		}
+	}
+	subs, err = s.db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(subs, []string{kept}) {
+		t.Fatalf("unexpected subscriptions after confirming a broken feed: %q", subs)
+	}
+}
+
+func TestSubscribeToWebsite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/one", "/two":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<link rel="alternate" type="application/rss+xml" href="/rss.xml">`)
+			if r.URL.Path == "/two" {
+				fmt.Fprint(w, `<link rel="alternate" type="application/atom+xml" href="/atom.xml">`)
+			}
+		default:
+			fmt.Fprint(w, `<rss version="2.0"><channel><title>the feed</title></channel></rss>`)
+		}
+	}))
+	defer srv.Close()
+
+	s, _ := newTestSite(t)
+	input := srv.URL + "/one\r\n" + srv.URL + "/two"
+	rec := postForm(s.settingsSubmitHandler, "/feeds/submit", url.Values{"submit": {input}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a preview, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		// one feed is swapped in for the website
+		"+ " + srv.URL + "/rss.xml\n    found on " + srv.URL + "/one",
+		`<input type="hidden" name="url" value="` + srv.URL + `/rss.xml">`,
+		// several are offered
+		"? " + srv.URL + "/two has 2 feeds",
+		`<input type="checkbox" name="url" value="` + srv.URL + `/atom.xml">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the preview:\n%s", want, body)
+		}
+	}
+
+	// websites can't be confirmed as if they were feeds
+	rec = postForm(s.settingsConfirmHandler, "/feeds/confirm", url.Values{"url": {srv.URL + "/two"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the feeds page, got %d: %s", rec.Code, rec.Body)
+	}
+	if want := "! " + srv.URL + "/two\n    this is a website, not a feed"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected %q on the feeds page:\n%s", want, rec.Body)
+	}
+	subs, err := s.db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 0 {
+		t.Fatalf("expected no subscriptions, got %q", subs)
+	}
+}
+
+func TestFinger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<p>a website with no links</p>`)
+		case "/rss.xml":
+			fmt.Fprint(w, `<rss version="2.0"><channel><title>hidden feed</title>
+				<item><guid>1</guid><link>http://example.com/1</link><title>post 1</title>
+				<pubDate>Mon, 03 Jun 2024 00:00:00 GMT</pubDate></item>
+				</channel></rss>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s, _ := newTestSite(t)
+	rec := postForm(s.fingerHandler, "/finger", url.Values{"url": {srv.URL + "/"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected results, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<b>hidden feed</b>",
+		"1 posts, last post 2024-06-03",
+		"found: common path",
+		`<input type="hidden" name="url" value="` + srv.URL + `/rss.xml">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+
+	rec = postForm(s.subscribeHandler, "/feeds/subscribe", url.Values{"url": {srv.URL + "/rss.xml"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect, got %d: %s", rec.Code, rec.Body)
+	}
+	subs, err := s.db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(subs, []string{srv.URL + "/rss.xml"}) {
+		t.Fatalf("expected to be subscribed, got %q", subs)
+	}
+
+	rec = postForm(s.fingerHandler, "/finger", url.Values{"url": {srv.URL + "/"}})
+	if !strings.Contains(rec.Body.String(), "✓ subscribed") {
+		t.Errorf("expected the feed to be marked as subscribed:\n%s", rec.Body)
+	}
+}
+
+type fakeArchiver struct {
+	name string
+	err  error
+}
+
+func (f fakeArchiver) Name() string { return f.name }
+
+func (f fakeArchiver) Archive(_ context.Context, u string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return "https://" + f.name + "/" + u, nil
+}
+
+func TestSave(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>feed</title><link>http://example.com/</link>
+			<item><guid>1</guid><link>http://example.com/1</link><title>post 1</title>
+			<description>&lt;p&gt;all &lt;b&gt;about&lt;/b&gt; it&lt;/p&gt;</description>
+			<category>go</category><category>feeds</category>
+			<enclosure url="http://example.com/1.mp3" type="audio/mpeg" length="1234"/></item>
+			</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	s, _ := newTestSite(t)
+	err := s.reaper.Fetch(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.archivers = []archive.Archiver{
+		fakeArchiver{name: "down", err: errors.New("oops")},
+		fakeArchiver{name: "up"},
+	}
+	s.archiveQueue = archive.NewQueue(s.db, s.archivers)
+
+	rec := serve(s.saveHandler, "POST", "/save/x", "url", url.QueryEscape("http://example.com/nope"))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected a 404 for an unknown item, got %d", rec.Code)
+	}
+
+	// the save is there straight away, before any archiving. a
+	// plain form is sent back to where it came from
+	rec = serve(s.saveHandler, "POST", "/save/x", "url", url.QueryEscape("http://example.com/1"))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/archive" {
+		t.Fatalf("expected a redirect, got %d to %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	saved, err := s.db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ArchiveStatus != sqlite.ArchivePending || len(saved[0].Archives) != 0 {
+		t.Fatalf("expected one pending save, got %+v", saved)
+	}
+
+	// then the queue archives it. one archiver failing doesn't
+	// stop the others
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.archiveQueue.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(saved[0].Archives) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the save was never archived: %+v", saved[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+		saved, err = s.db.GetUserSavedItems("reader")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if saved[0].ArchiveURL != "https://up/http://example.com/1" {
+		t.Errorf("unexpected archive url %q", saved[0].ArchiveURL)
+	}
+
+	// along with everything about the post, as it was when saved
+	rec = serve(s.userSavesHandler, "GET", "/archive")
+	for _, want := range []string{
+		`<a href="https://up/http://example.com/1">up</a>`,
+		`Feed: <a href="http://example.com/">feed</a> (<a href="` + srv.URL + `">feed</a>)`,
+		"Categories: go, feeds",
+		`Enclosure: <a href="http://example.com/1.mp3">http://example.com/1.mp3</a> (audio/mpeg)`,
+		"\nall about it\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected the archive page to have %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestIsFetch(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"":            false,
+		"navigate":    false,
+		"cors":        true,
+		"same-origin": true,
+	} {
+		req := httptest.NewRequest("POST", "/save/x", nil)
+		if mode != "" {
+			req.Header.Set("Sec-Fetch-Mode", mode)
+		}
+		if got := isFetch(req); got != want {
+			t.Errorf("isFetch with Sec-Fetch-Mode %q = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestManageSaves(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>feed</title>
+			<item><guid>1</guid><link>http://example.com/1</link><title>post 1</title></item>
+			</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	s, _ := newTestSite(t)
+	err := s.reaper.Fetch(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.db.Subscribe("reader", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.db.QueueSavedItem("reader", sqlite.SavedItem{ItemTitle: "post 1", ItemURL: "http://example.com/1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := fmt.Sprint(id)
+
+	marked := func() bool {
+		rec := serve(s.userHandler, "GET", "/reader", "username", "reader")
+		return strings.Contains(rec.Body.String(), `<a href="/archive">saved</a>`)
+	}
+	if !marked() {
+		t.Error("expected the timeline to mark the post as saved")
+	}
+
+	rec := postForm(s.saveNoteHandler, "/archive/"+sid+"/note", url.Values{"note": {"<b>so good</b>"}}, "id", sid)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected the note to be saved, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(s.userSavesHandler, "GET", "/archive")
+	if !strings.Contains(rec.Body.String(), "<p>&lt;b&gt;so good&lt;/b&gt;</p>") {
+		t.Errorf("expected the note on the archive page:\n%s", rec.Body)
+	}
+	long := url.Values{"note": {strings.Repeat("a", maxNoteLength+1)}}
+	if rec := postForm(s.saveNoteHandler, "/archive/"+sid+"/note", long, "id", sid); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a long note, got %d", rec.Code)
+	}
+
+	rec = postForm(s.deleteSaveHandler, "/archive/"+sid+"/delete", nil, "id", sid)
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/archive?deleted="+sid {
+		t.Fatalf("expected a redirect offering undo, got %d to %q", rec.Code, loc)
+	}
+	rec = serve(s.userSavesHandler, "GET", "/archive?deleted="+sid)
+	if strings.Contains(rec.Body.String(), "post 1") {
+		t.Errorf("expected the deleted save to be gone:\n%s", rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `action="/archive/`+sid+`/restore"`) {
+		t.Errorf("expected an undo button:\n%s", rec.Body)
+	}
+	if marked() {
+		t.Error("didn't expect a deleted save to be marked")
+	}
+
+	rec = postForm(s.restoreSaveHandler, "/archive/"+sid+"/restore", nil, "id", sid)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected the save to be restored, got %d: %s", rec.Code, rec.Body)
+	}
+	if !marked() {
+		t.Error("expected the restored save to be marked again")
+	}
+
+	for _, bad := range []string{"nope", "999"} {
+		rec = postForm(s.deleteSaveHandler, "/archive/"+bad+"/delete", nil, "id", bad)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected a 404, got %d", bad, rec.Code)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<p>hi</p>`)
+	}))
+	defer page.Close()
+
+	s, _ := newTestSite(t)
+	s.snapshots = &archive.Local{Dir: t.TempDir(), Client: page.Client()}
+	u, err := s.snapshots.Archive(context.Background(), page.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(s.snapshotHandler, "GET", u, "id", strings.TrimPrefix(u, "/archive/"))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<p>hi</p>") {
+		t.Fatalf("unexpected snapshot %d: %s", rec.Code, rec.Body)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Fatalf("expected snapshots to be sandboxed, got %q", csp)
+	}
+
+	for _, id := range []string{"nope", strings.TrimPrefix(u, "/archive/") + ".warc"} {
+		rec = serve(s.snapshotHandler, "GET", "/archive/"+id, "id", id)
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected a 404, got %d", id, rec.Code)
+		}
+	}
+}
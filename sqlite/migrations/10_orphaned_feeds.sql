@@ -0,0 +1,3 @@
+-- when a feed was first seen without any subscribers, so that
+-- the reaper can garbage collect it after a grace period
+ALTER TABLE feed ADD COLUMN orphaned_at TIMESTAMP;
@@ -0,0 +1,18 @@
+-- every copy of a saved item that an archiver made.
+-- saved_item.archive_url is kept as one of these; see 16 for
+-- which.
+CREATE TABLE saved_item_archive (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    saved_item_id INTEGER NOT NULL,
+    archiver TEXT NOT NULL,
+    url TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (saved_item_id) REFERENCES saved_item(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_saved_item_archive_saved_item ON saved_item_archive(saved_item_id);
+
+-- everything saved so far went to the wayback machine
+INSERT INTO saved_item_archive (saved_item_id, archiver, url, created_at)
+SELECT id, 'archive.org', archive_url, created_at FROM saved_item
+WHERE archive_url != '';
@@ -0,0 +1,21 @@
+-- saves are archived in the background: each archiver that a
+-- save goes to gets a job, which is retried with backoff until it
+-- works or runs out of attempts.
+CREATE TABLE archive_job (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    saved_item_id INTEGER NOT NULL,
+    archiver TEXT NOT NULL,
+    -- pending, done or failed
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    -- a claimed job is pushed into the future, so that if vore
+    -- dies halfway through, the job is picked up again later
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (saved_item_id) REFERENCES saved_item(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX idx_archive_job_saved_item ON archive_job(saved_item_id, archiver);
+
+CREATE INDEX idx_archive_job_due ON archive_job(status, next_attempt_at);
@@ -0,0 +1,11 @@
+-- what a post looked like when it was saved, so that saves keep
+-- everything about it after it drops out of its feed. saves from
+-- before this have none of it.
+-- json encoded rss.Item
+ALTER TABLE saved_item ADD COLUMN item_data TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE saved_item ADD COLUMN feed_url TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE saved_item ADD COLUMN feed_title TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE saved_item ADD COLUMN feed_link TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- deleted saves are hidden rather than removed, so that a
+-- deletion can be undone
+ALTER TABLE saved_item ADD COLUMN deleted_at TIMESTAMP;
+
+-- the user's own note about a save, only ever shown to them
+ALTER TABLE saved_item ADD COLUMN note TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_saved_item_user_url ON saved_item(user_id, item_url);
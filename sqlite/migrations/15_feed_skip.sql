@@ -0,0 +1,6 @@
+-- the hours & days a feed asks not to be checked in (RSS skipHours
+-- & skipDays), kept for the same reason as ttl_seconds. json
+-- encoded lists.
+ALTER TABLE feed ADD COLUMN skip_hours TEXT NOT NULL DEFAULT '[]';
+
+ALTER TABLE feed ADD COLUMN skip_days TEXT NOT NULL DEFAULT '[]';
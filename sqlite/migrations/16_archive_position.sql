@@ -0,0 +1,9 @@
+-- where an archiver came in the configured list when a job was
+-- queued for it, so that a save's copies can be shown in that
+-- order, & so that saved_item.archive_url is the copy from the
+-- first archiver that made one, rather than whichever was quickest.
+-- what came before has no record of the order, so it's all 0 &
+-- falls back to the order the copies were made in.
+ALTER TABLE archive_job ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE saved_item_archive ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- http cache validators from the last successful fetch, sent back
+-- as If-None-Match / If-Modified-Since on the next refresh
+ALTER TABLE feed ADD COLUMN etag TEXT;
+
+ALTER TABLE feed ADD COLUMN last_modified TEXT;
@@ -0,0 +1,27 @@
+-- parsed feed state, so that the reaper can serve timelines
+-- straight after a restart instead of waiting for a refresh
+ALTER TABLE feed ADD COLUMN title TEXT;
+
+ALTER TABLE feed ADD COLUMN description TEXT;
+
+ALTER TABLE feed ADD COLUMN link TEXT;
+
+ALTER TABLE feed ADD COLUMN language TEXT;
+
+ALTER TABLE feed ADD COLUMN author TEXT;
+
+ALTER TABLE feed ADD COLUMN refresh_at TIMESTAMP;
+
+CREATE TABLE feed_item (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    feed_id INTEGER NOT NULL,
+    guid TEXT NOT NULL,
+    link TEXT NOT NULL,
+    -- json encoded rss.Item
+    data TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (feed_id) REFERENCES feed(id) ON DELETE CASCADE,
+    UNIQUE(feed_id, guid)
+);
+
+CREATE INDEX idx_feed_item_feed ON feed_item(feed_id);
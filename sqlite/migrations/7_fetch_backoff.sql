@@ -0,0 +1,5 @@
+-- consecutive fetch failures & when the reaper may try again,
+-- so failing feeds back off (and stay backed off across restarts)
+ALTER TABLE feed ADD COLUMN fetch_failures INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE feed ADD COLUMN next_attempt_at TIMESTAMP;
@@ -0,0 +1,3 @@
+-- the refresh interval a feed asked for itself (RSS ttl). kept so
+-- it's still honoured after a restart, when refreshes come back 304.
+ALTER TABLE feed ADD COLUMN ttl_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,21 @@
+-- one row per fetch attempt, so the feed health page can show
+-- whether a feed is flaky, slow or growing. old rows are pruned
+-- by the reaper.
+CREATE TABLE fetch_attempt (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    feed_id INTEGER NOT NULL,
+    attempted_at TIMESTAMP NOT NULL,
+    -- 0 if no response came back at all
+    http_status INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    bytes INTEGER NOT NULL DEFAULT 0,
+    new_items INTEGER NOT NULL DEFAULT 0,
+    -- empty for a successful fetch
+    error_class TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (feed_id) REFERENCES feed(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_fetch_attempt_feed ON fetch_attempt(feed_id, attempted_at);
+
+CREATE INDEX idx_fetch_attempt_attempted_at ON fetch_attempt(attempted_at);
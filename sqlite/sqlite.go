@@ -3,12 +3,14 @@ package sqlite
 import (
 	"database/sql"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
-	"log"
-	"strings"
+	"slices"
 	"time"
 
+	"git.j3s.sh/vore/rss"
 	_ "github.com/glebarez/go-sqlite"
 )
 
@@ -19,90 +21,215 @@ type DB struct {
 	sql *sql.DB
 }
 
+// ErrNotFound is wrapped by errors about users, feeds or saved
+// items that don't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is wrapped by errors about adding something, like a
+// user, that's already there.
+var ErrExists = errors.New("already exists")
+
+// IsBusy reports whether err means the database was too busy
+// to answer (SQLITE_BUSY or SQLITE_LOCKED), in which case the
+// same query may well work if it's tried again later.
+func IsBusy(err error) bool {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return false
+	}
+	// extended result codes keep the primary code in the low byte
+	switch coded.Code() & 0xff {
+	case sqliteBusy, sqliteLocked:
+		return true
+	}
+	return false
+}
+
+// isConstraint reports whether err means a query broke one of
+// the schema's constraints, such as a UNIQUE column.
+func isConstraint(err error) bool {
+	var coded interface{ Code() int }
+	return errors.As(err, &coded) && coded.Code()&0xff == sqliteConstraint
+}
+
+const (
+	sqliteBusy       = 5
+	sqliteLocked     = 6
+	sqliteConstraint = 19
+)
+
 type SavedItem struct {
+	ID int
+	// ArchiveURL is the first of Archives
 	ArchiveURL string
 	CreatedAt  time.Time
 	ItemTitle  string
 	ItemURL    string
+	Archives   []SavedItemArchive
+	// ArchiveStatus is pending while any archiver is still
+	// working on the item, then done if any of them made a
+	// copy, or failed if they all gave up
+	ArchiveStatus string
+	// ArchiveError is the most recent archiver error, if any
+	ArchiveError string
+	// Note is the user's own note about the save
+	Note string
+
+	// Item is the post as it was when it was saved. it's nil for
+	// saves from before vore kept it.
+	Item *rss.Item
+	// the feed the post came from
+	FeedURL   string
+	FeedTitle string
+	FeedLink  string
+}
+
+// the states of a saved item's archiving, & of each archive job
+const (
+	ArchivePending = "pending"
+	ArchiveDone    = "done"
+	ArchiveFailed  = "failed"
+)
+
+// SavedItemArchive is a copy of a saved item, made by an archiver.
+type SavedItemArchive struct {
+	Archiver string
+	URL      string
+}
+
+// FeedFetchState describes how fetches of a feed have been going.
+type FeedFetchState struct {
+	// Error is the last fetch error, if the last fetch failed
+	Error string
+	// Failures is the number of fetches in a row that have failed
+	Failures int
+	// NextAttempt is the earliest time the feed should be fetched
+	// again, or the zero time if it isn't backing off
+	NextAttempt time.Time
+}
+
+// FetchAttempt is the record of a single fetch of a feed.
+type FetchAttempt struct {
+	At time.Time
+	// Status is the HTTP status code, or 0 if no response came back
+	Status   int
+	Duration time.Duration
+	// Bytes is the size of the response body that was read
+	Bytes    int64
+	NewItems int
+	// ErrorClass is a short category for a failed fetch (e.g.
+	// "timeout" or "parse"), and empty for a successful one
+	ErrorClass string
+	Error      string
+}
+
+// OK reports whether the fetch succeeded.
+func (a FetchAttempt) OK() bool {
+	return a.ErrorClass == ""
+}
+
+// FetchStats summarises the retained fetch history of a feed.
+type FetchStats struct {
+	Attempts    int
+	Successes   int
+	AvgDuration time.Duration
+	NewItems    int
+}
+
+// SuccessRate returns the percentage of attempts that succeeded.
+func (s FetchStats) SuccessRate() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return 100 * float64(s.Successes) / float64(s.Attempts)
 }
 
 // New opens a sqlite database, populates it with tables, and
 // returns a ready-to-use *sqlite.DB object which is used for
 // abstracting database queries.
-func New(path string) *DB {
+func New(path string) (*DB, error) {
 	db, err := sql.Open("sqlite", path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	var latestVersion int
-	row := db.QueryRow("SELECT MAX(version) FROM schema_migrations")
-	err = row.Scan(&latestVersion)
+	var latestVersion sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&latestVersion)
 	if err != nil {
-		if strings.Contains(err.Error(), "converting NULL to int is unsupported") {
-			// assume that we're starting from ground zero
-			latestVersion = 0
-		} else {
-			log.Fatal(err)
-		}
+		return nil, err
 	}
 
 	files, err := fs.ReadDir(migrationFiles, "migrations")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	// files come back sorted by name, which would put
+	// 10_foo.sql before 1_init.sql
+	versions := make(map[string]int)
 	for _, f := range files {
 		var version int
 		_, err = fmt.Sscanf(f.Name(), "%d_", &version)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("bad migration name %s: %w", f.Name(), err)
 		}
+		versions[f.Name()] = version
+	}
+	slices.SortFunc(files, func(a, b fs.DirEntry) int {
+		return versions[a.Name()] - versions[b.Name()]
+	})
+
+	for _, f := range files {
+		version := versions[f.Name()]
 
 		// Apply migration if not already applied
-		if version > latestVersion {
+		if int64(version) > latestVersion.Int64 {
 			fileData, _ := fs.ReadFile(migrationFiles, "migrations/"+f.Name())
 			_, err := db.Exec(string(fileData))
 			if err != nil {
-				log.Fatalf("Failed to apply migration %s: %v", f.Name(), err)
+				return nil, fmt.Errorf("failed to apply migration %s: %w", f.Name(), err)
 			}
 			_, err = db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version)
 			if err != nil {
-				log.Fatalf("Failed to record migration version %d: %v", version, err)
+				return nil, fmt.Errorf("failed to record migration version %d: %w", version, err)
 			}
 			fmt.Printf("Applied migration %s\n", f.Name())
 		}
 	}
 
-	return &DB{sql: db}
+	return &DB{sql: db}, nil
 }
 
-func (db *DB) GetUsernameBySessionToken(token string) string {
+// Close waits for any queries that have started to finish, then
+// closes the database.
+func (db *DB) Close() error {
+	return db.sql.Close()
+}
+
+// GetUsernameBySessionToken returns the user the given session
+// token belongs to, or "" if it doesn't belong to anybody.
+func (db *DB) GetUsernameBySessionToken(token string) (string, error) {
 	var username string
 	err := db.sql.QueryRow("SELECT username FROM user WHERE session_token=?", token).Scan(&username)
 	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		log.Fatal(err)
+		return "", nil
 	}
-	return username
+	return username, err
 }
 
-func (db *DB) GetPassword(username string) string {
+// GetPassword returns the password hash of the given user, or ""
+// if there's no such user.
+func (db *DB) GetPassword(username string) (string, error) {
 	var password string
 	err := db.sql.QueryRow("SELECT password FROM user WHERE username=?", username).Scan(&password)
 	if err == sql.ErrNoRows {
-		return ""
-	}
-	if err != nil {
-		log.Fatal(err)
+		return "", nil
 	}
-	return password
+	return password, err
 }
 
 func (db *DB) GetSessionToken(username string) (string, error) {
@@ -121,65 +248,38 @@ func (db *DB) SetSessionToken(username string, token string) error {
 
 func (db *DB) AddUser(username string, passwordHash string) error {
 	_, err := db.sql.Exec("INSERT INTO user (username, password) VALUES (?, ?)", username, passwordHash)
-	return err
-}
-
-func (db *DB) subscribe(uid int, fid int) {
-	var id int
-	err := db.sql.QueryRow("SELECT id FROM subscribe WHERE user_id=? AND feed_id=?", uid, fid).Scan(&id)
-	if err == sql.ErrNoRows {
-		_, err := db.sql.Exec("INSERT INTO subscribe (user_id, feed_id) VALUES (?, ?)", uid, fid)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return
-	}
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func (db *DB) unsubscribeAll(uid int) {
-	_, err := db.sql.Exec("DELETE FROM subscribe WHERE user_id=?", uid)
-	if err != nil {
-		log.Fatal(err)
+	if isConstraint(err) {
+		return fmt.Errorf("user '%s': %w", username, ErrExists)
 	}
+	return err
 }
 
-func (db *DB) UserExists(username string) bool {
+func (db *DB) UserExists(username string) (bool, error) {
 	var result string
 	err := db.sql.QueryRow("SELECT username FROM user WHERE username=?", username).Scan(&result)
 	if err == sql.ErrNoRows {
-		return false
+		return false, nil
 	}
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	return true
+	return true, nil
 }
 
-func (db *DB) GetAllFeedURLs() []string {
+func (db *DB) GetAllFeedURLs() ([]string, error) {
 	// TODO: BAD SELECT STATEMENT!! SORRY :( --wesley
 	rows, err := db.sql.Query("SELECT url FROM feed")
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer rows.Close()
-
-	var urls []string
-	for rows.Next() {
-		var url string
-		err = rows.Scan(&url)
-		if err != nil {
-			log.Fatal(err)
-		}
-		urls = append(urls, url)
+		return nil, err
 	}
-	return urls
+	return scanStrings(rows)
 }
 
-func (db *DB) GetUserFeedURLs(username string) []string {
-	uid := db.GetUserID(username)
+func (db *DB) GetUserFeedURLs(username string) ([]string, error) {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
 
 	// this query returns sql rows representing the list of
 	// rss feed urls the user is subscribed to
@@ -189,115 +289,732 @@ func (db *DB) GetUserFeedURLs(username string) []string {
 		JOIN subscribe s ON f.id = s.feed_id
 		JOIN user u ON s.user_id = u.id
 		WHERE u.id = ?`, uid)
-	if err == sql.ErrNoRows {
-		return []string{}
-	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return scanStrings(rows)
+}
+
+// scanStrings reads a single string column out of every row,
+// and closes rows.
+func scanStrings(rows *sql.Rows) ([]string, error) {
 	defer rows.Close()
 
-	var urls []string
+	var result []string
 	for rows.Next() {
-		var url string
-		err = rows.Scan(&url)
+		var s string
+		err := rows.Scan(&s)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		urls = append(urls, url)
+		result = append(result, s)
 	}
-	return urls
+	return result, rows.Err()
 }
 
-func (db *DB) GetUserSavedItems(username string) []SavedItem {
-	uid := db.GetUserID(username)
-
-	rows, err := db.sql.Query(`SELECT item_url, item_title, archive_url, created_at
-				FROM saved_item WHERE user_id = ?
-				ORDER BY created_at DESC`, uid)
-	if err == sql.ErrNoRows {
-		return []SavedItem{}
+func (db *DB) GetUserSavedItems(username string) ([]SavedItem, error) {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return nil, err
 	}
+
+	rows, err := db.sql.Query(`SELECT s.id, s.item_url, s.item_title, s.archive_url, s.created_at,
+				s.item_data, s.feed_url, s.feed_title, s.feed_link, s.note,
+				CASE
+					WHEN EXISTS (SELECT 1 FROM archive_job j
+						WHERE j.saved_item_id = s.id AND j.status = 'pending') THEN 'pending'
+					WHEN EXISTS (SELECT 1 FROM saved_item_archive a
+						WHERE a.saved_item_id = s.id) THEN 'done'
+					WHEN EXISTS (SELECT 1 FROM archive_job j
+						WHERE j.saved_item_id = s.id AND j.status = 'failed') THEN 'failed'
+					ELSE 'done'
+				END,
+				COALESCE((SELECT j.last_error FROM archive_job j
+					WHERE j.saved_item_id = s.id AND j.last_error != ''
+					ORDER BY j.id DESC LIMIT 1), '')
+				FROM saved_item s WHERE s.user_id = ? AND s.deleted_at IS NULL
+				ORDER BY s.created_at DESC, s.id DESC`, uid)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 
 	var savedItems []SavedItem
+	byID := make(map[int]int)
 	for rows.Next() {
 		var si SavedItem
-		err = rows.Scan(&si.ItemURL, &si.ItemTitle, &si.ArchiveURL, &si.CreatedAt)
+		var data string
+		err = rows.Scan(&si.ID, &si.ItemURL, &si.ItemTitle, &si.ArchiveURL, &si.CreatedAt,
+			&data, &si.FeedURL, &si.FeedTitle, &si.FeedLink, &si.Note,
+			&si.ArchiveStatus, &si.ArchiveError)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		if data != "" {
+			si.Item = new(rss.Item)
+			err = json.Unmarshal([]byte(data), si.Item)
+			if err != nil {
+				return nil, fmt.Errorf("saved item %d: %w", si.ID, err)
+			}
 		}
+		byID[si.ID] = len(savedItems)
 		savedItems = append(savedItems, si)
 	}
-	return savedItems
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.sql.Query(`SELECT a.saved_item_id, a.archiver, a.url
+				FROM saved_item_archive a
+				JOIN saved_item s ON a.saved_item_id = s.id
+				WHERE s.user_id = ?
+				ORDER BY a.position, a.id`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var a SavedItemArchive
+		err = rows.Scan(&id, &a.Archiver, &a.URL)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := byID[id]; ok {
+			savedItems[i].Archives = append(savedItems[i].Archives, a)
+		}
+	}
+	return savedItems, rows.Err()
+}
+
+// GetUserSavedURLs returns the urls of every post the user has
+// saved, & not deleted.
+func (db *DB) GetUserSavedURLs(username string) (map[string]bool, error) {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.sql.Query(`SELECT DISTINCT item_url FROM saved_item
+				WHERE user_id = ? AND deleted_at IS NULL`, uid)
+	if err != nil {
+		return nil, err
+	}
+	urls, err := scanStrings(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	savedURLs := make(map[string]bool)
+	for _, itemURL := range urls {
+		savedURLs[itemURL] = true
+	}
+	return savedURLs, nil
 }
 
-func (db *DB) GetUserID(username string) int {
+// DeleteSavedItem hides one of the user's saves, until it's
+// restored with RestoreSavedItem.
+func (db *DB) DeleteSavedItem(username string, id int) error {
+	return db.updateSavedItem(username, id, `UPDATE saved_item SET deleted_at = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, time.Now().UTC())
+}
+
+// RestoreSavedItem undoes DeleteSavedItem.
+func (db *DB) RestoreSavedItem(username string, id int) error {
+	return db.updateSavedItem(username, id, `UPDATE saved_item SET deleted_at = NULL
+		WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL`)
+}
+
+// SetSavedItemNote replaces the note on one of the user's saves.
+func (db *DB) SetSavedItemNote(username string, id int, note string) error {
+	return db.updateSavedItem(username, id, `UPDATE saved_item SET note = ?
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, note)
+}
+
+// updateSavedItem runs query, an UPDATE of a single save, with
+// args followed by the save's id & the user's id. the error wraps
+// ErrNotFound if nothing was updated, so that nobody can touch
+// anyone else's saves.
+func (db *DB) updateSavedItem(username string, id int, query string, args ...any) error {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	res, err := db.sql.Exec(query, append(args, id, uid)...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("saved item %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// GetUserID returns the id of the given user. the error wraps
+// ErrNotFound if there's no such user.
+func (db *DB) GetUserID(username string) (int, error) {
 	var uid int
 	err := db.sql.QueryRow("SELECT id FROM user WHERE username=?", username).Scan(&uid)
-	if err != nil {
-		log.Fatal(err)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("user '%s': %w", username, ErrNotFound)
 	}
-	return uid
+	return uid, err
 }
 
-func (db *DB) GetFeedID(feedURL string) int {
+// GetFeedID returns the id of the feed at the given url. the
+// error wraps ErrNotFound if there's no such feed.
+func (db *DB) GetFeedID(feedURL string) (int, error) {
 	var fid int
 	err := db.sql.QueryRow("SELECT id FROM feed WHERE url=?", feedURL).Scan(&fid)
-	if err != nil {
-		log.Fatal(err)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("feed '%s': %w", feedURL, ErrNotFound)
 	}
-	return fid
+	return fid, err
 }
 
 // WriteFeed writes an rss feed to the database for permanent storage
-// if the given feed already exists, WriteFeed does nothing.
-func (db *DB) WriteFeed(url string) {
+// if the given feed already exists, it's only marked as no longer
+// orphaned.
+func (db *DB) WriteFeed(url string) error {
+	// someone's about to subscribe, so the feed is no longer
+	// orphaned. this keeps ReapOrphanedFeeds from deleting it
+	// before the subscription lands.
 	_, err := db.sql.Exec(`INSERT INTO feed(url) VALUES(?)
-				ON CONFLICT(url) DO NOTHING`, url)
+				ON CONFLICT(url) DO UPDATE SET orphaned_at=NULL`, url)
+	return err
+}
+
+// WriteSavedItem saves an item & every archived copy of it.
+// if item.ArchiveURL is empty, the first archive's url is used.
+func (db *DB) WriteSavedItem(username string, item SavedItem) error {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	if item.ArchiveURL == "" && len(item.Archives) > 0 {
+		item.ArchiveURL = item.Archives[0].URL
+	}
+
+	tx, err := db.sql.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	id, err := insertSavedItem(tx, uid, item)
+	if err != nil {
+		return err
+	}
+	for i, a := range item.Archives {
+		_, err = tx.Exec(`
+		INSERT INTO saved_item_archive(saved_item_id, archiver, url, position)
+		VALUES(?, ?, ?, ?)`, id, a.Archiver, a.URL, i)
+		if err != nil {
+			return err
+		}
 	}
+	return tx.Commit()
 }
 
-func (db *DB) WriteSavedItem(username string, item SavedItem) error {
-	uid := db.GetUserID(username)
+// insertSavedItem adds item to the saved items of the user with
+// the given id, & returns its id. Archives isn't written.
+func insertSavedItem(tx *sql.Tx, uid int, item SavedItem) (int, error) {
+	var data []byte
+	if item.Item != nil {
+		var err error
+		data, err = json.Marshal(item.Item)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var id int
+	err := tx.QueryRow(`
+	INSERT INTO saved_item(user_id, item_url, item_title, archive_url,
+		item_data, feed_url, feed_title, feed_link)
+	VALUES(?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		uid, item.ItemURL, item.ItemTitle, item.ArchiveURL,
+		string(data), item.FeedURL, item.FeedTitle, item.FeedLink).Scan(&id)
+	return id, err
+}
+
+// QueueSavedItem saves an item straight away, with a pending
+// archive job for each of archivers, & returns its id. archivers
+// go in order of preference, which decides the item's ArchiveURL.
+func (db *DB) QueueSavedItem(username string, item SavedItem, archivers []string) (int, error) {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	item.ArchiveURL = ""
+	id, err := insertSavedItem(tx, uid, item)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	for i, archiver := range archivers {
+		_, err = tx.Exec(`
+		INSERT INTO archive_job(saved_item_id, archiver, next_attempt_at, position)
+		VALUES(?, ?, ?, ?)`, id, archiver, now, i)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// ArchiveJob is a saved item waiting to be archived by one
+// archiver.
+type ArchiveJob struct {
+	ID          int
+	SavedItemID int
+	Archiver    string
+	ItemURL     string
+	// Attempts counts the one under way
+	Attempts int
+}
+
+// QueueMissingArchiveJobs queues a job with the given archiver for
+// every saved item that has neither a copy from it nor a job for
+// it, like those saved before it was turned on. position is where
+// the archiver comes in the configured list, as for
+// QueueSavedItem. it returns how many jobs were queued.
+func (db *DB) QueueMissingArchiveJobs(archiver string, position int) (int64, error) {
+	res, err := db.sql.Exec(`
+	INSERT INTO archive_job(saved_item_id, archiver, next_attempt_at, position)
+	SELECT s.id, ?, ?, ? FROM saved_item s
+	WHERE NOT EXISTS (
+		SELECT 1 FROM saved_item_archive a
+		WHERE a.saved_item_id = s.id AND a.archiver = ?
+	) AND NOT EXISTS (
+		SELECT 1 FROM archive_job j
+		WHERE j.saved_item_id = s.id AND j.archiver = ?
+	)`, archiver, time.Now().UTC(), position, archiver, archiver)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClaimArchiveJob takes the pending job that's been due longest,
+// and pushes it back to until, so that nothing else takes it in
+// the meantime. it returns nil if nothing is due.
+func (db *DB) ClaimArchiveJob(now time.Time, until time.Time) (*ArchiveJob, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var job ArchiveJob
+	err = tx.QueryRow(`
+	UPDATE archive_job SET next_attempt_at = ?, attempts = attempts + 1
+	WHERE id = (
+		SELECT id FROM archive_job
+		WHERE status = 'pending' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id LIMIT 1
+	)
+	RETURNING id, saved_item_id, archiver, attempts`, until.UTC(), now.UTC()).
+		Scan(&job.ID, &job.SavedItemID, &job.Archiver, &job.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow("SELECT item_url FROM saved_item WHERE id = ?", job.SavedItemID).Scan(&job.ItemURL)
+	if err != nil {
+		return nil, err
+	}
+	return &job, tx.Commit()
+}
+
+// FinishArchiveJob marks a job done & records the copy it made.
+// the copy from the most preferred archiver that's made one
+// becomes the item's ArchiveURL.
+func (db *DB) FinishArchiveJob(id int, archiveURL string) error {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	var savedItemID, position int
+	var archiver string
+	err = tx.QueryRow(`
+	UPDATE archive_job SET status = 'done', last_error = ''
+	WHERE id = ? RETURNING saved_item_id, archiver, position`, id).Scan(&savedItemID, &archiver, &position)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("archive job %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO saved_item_archive(saved_item_id, archiver, url, position)
+	VALUES(?, ?, ?, ?)`, savedItemID, archiver, archiveURL, position)
+	if err != nil {
+		return err
+	}
+	// take over from nothing, or from a less preferred copy
+	_, err = tx.Exec(`
+	UPDATE saved_item SET archive_url = ?
+	WHERE id = ? AND (archive_url = '' OR archive_url IN (
+		SELECT url FROM saved_item_archive
+		WHERE saved_item_id = ? AND position > ?
+	))`, archiveURL, savedItemID, savedItemID, position)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RetryArchiveJob puts a job that didn't work back in the queue,
+// to be tried again at at.
+func (db *DB) RetryArchiveJob(id int, at time.Time, lastError string) error {
 	_, err := db.sql.Exec(`
-	INSERT INTO saved_item(user_id, item_url, item_title, archive_url)
-	VALUES(?, ?, ?, ?)`, uid, item.ItemURL, item.ItemTitle, item.ArchiveURL)
+	UPDATE archive_job SET next_attempt_at = ?, last_error = ?
+	WHERE id = ?`, at.UTC(), lastError, id)
+	return err
+}
 
+// ReleaseArchiveJob puts a claimed job back, to be tried again at
+// the given time, without counting the claim as an attempt. it's
+// for jobs that were interrupted rather than failed.
+func (db *DB) ReleaseArchiveJob(id int, at time.Time) error {
+	_, err := db.sql.Exec(`
+	UPDATE archive_job SET next_attempt_at = ?, attempts = max(attempts - 1, 0)
+	WHERE id = ?`, at.UTC(), id)
 	return err
 }
 
-// WriteFeed writes an rss feed to the database for permanent storage
-// if the given feed already exists, WriteFeed does nothing.
-func (db *DB) SetFeedFetchError(url string, fetchErr string) error {
-	_, err := db.sql.Exec("UPDATE feed SET fetch_error=? WHERE url=?", fetchErr, url)
+// FailArchiveJob gives up on a job.
+func (db *DB) FailArchiveJob(id int, lastError string) error {
+	_, err := db.sql.Exec(`
+	UPDATE archive_job SET status = 'failed', last_error = ?
+	WHERE id = ?`, lastError, id)
+	return err
+}
+
+// SetFeedFetchFailure records a failed fetch of the given feed:
+// the error, how many fetches in a row have now failed, and the
+// earliest time the reaper should try again.
+func (db *DB) SetFeedFetchFailure(url string, fetchErr string, failures int, nextAttempt time.Time) error {
+	_, err := db.sql.Exec(`
+		UPDATE feed SET fetch_error=?, fetch_failures=?, next_attempt_at=?
+		WHERE url=?`, fetchErr, failures, nextAttempt, url)
+	return err
+}
+
+// ClearFeedFetchFailure resets the fetch failure state of the
+// given feed after a successful fetch.
+func (db *DB) ClearFeedFetchFailure(url string) error {
+	_, err := db.sql.Exec(`
+		UPDATE feed SET fetch_error=NULL, fetch_failures=0, next_attempt_at=NULL
+		WHERE url=?`, url)
+	return err
+}
+
+// GetFeedFetchState returns the fetch failure state of the given
+// feed. a healthy feed has a zero FeedFetchState.
+func (db *DB) GetFeedFetchState(url string) (FeedFetchState, error) {
+	var state FeedFetchState
+	var fetchErr sql.NullString
+	var nextAttempt sql.NullTime
+	err := db.sql.QueryRow(`
+		SELECT fetch_error, fetch_failures, next_attempt_at
+		FROM feed WHERE url=?`, url).Scan(&fetchErr, &state.Failures, &nextAttempt)
+	if err != nil {
+		return FeedFetchState{}, err
+	}
+	state.Error = fetchErr.String
+	state.NextAttempt = nextAttempt.Time
+	return state, nil
+}
+
+// RecordFetchAttempt adds a to the fetch history of the feed at
+// url. attempts for feeds that aren't in the db are dropped.
+// times are stored in utc so that they sort correctly.
+func (db *DB) RecordFetchAttempt(url string, a FetchAttempt) error {
+	_, err := db.sql.Exec(`
+		INSERT INTO fetch_attempt(feed_id, attempted_at, http_status, duration_ms, bytes, new_items, error_class, error)
+		SELECT id, ?, ?, ?, ?, ?, ?, ? FROM feed WHERE url=?`,
+		a.At.UTC(), a.Status, a.Duration.Milliseconds(), a.Bytes, a.NewItems, a.ErrorClass, a.Error, url)
+	return err
+}
+
+// GetFetchAttempts returns the most recent fetch attempts of the
+// feed at url, newest first.
+func (db *DB) GetFetchAttempts(url string, limit int) ([]FetchAttempt, error) {
+	rows, err := db.sql.Query(`
+		SELECT a.attempted_at, a.http_status, a.duration_ms, a.bytes, a.new_items, a.error_class, a.error
+		FROM fetch_attempt a
+		JOIN feed f ON a.feed_id = f.id
+		WHERE f.url = ?
+		ORDER BY a.attempted_at DESC, a.id DESC
+		LIMIT ?`, url, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []FetchAttempt
+	for rows.Next() {
+		var a FetchAttempt
+		var ms int64
+		err = rows.Scan(&a.At, &a.Status, &ms, &a.Bytes, &a.NewItems, &a.ErrorClass, &a.Error)
+		if err != nil {
+			return nil, err
+		}
+		a.Duration = time.Duration(ms) * time.Millisecond
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// GetFetchStats summarises every retained fetch attempt of the
+// feed at url.
+func (db *DB) GetFetchStats(url string) (FetchStats, error) {
+	var stats FetchStats
+	var avgMS float64
+	err := db.sql.QueryRow(`
+		SELECT COUNT(*),
+			COALESCE(SUM(a.error_class = ''), 0),
+			COALESCE(AVG(a.duration_ms), 0),
+			COALESCE(SUM(a.new_items), 0)
+		FROM fetch_attempt a
+		JOIN feed f ON a.feed_id = f.id
+		WHERE f.url = ?`, url).Scan(&stats.Attempts, &stats.Successes, &avgMS, &stats.NewItems)
+	if err != nil {
+		return FetchStats{}, err
+	}
+	stats.AvgDuration = time.Duration(avgMS * float64(time.Millisecond))
+	return stats, nil
+}
+
+// PruneFetchAttempts deletes every fetch attempt made before
+// the given time, and returns how many were deleted.
+func (db *DB) PruneFetchAttempts(before time.Time) (int64, error) {
+	// timestamps are stored as text, so compare them in utc
+	res, err := db.sql.Exec("DELETE FROM fetch_attempt WHERE attempted_at < ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// WriteFeedCache stores the parsed state of a feed (metadata,
+// cache validators & items) so that it can be served straight
+// away after a restart. the feed row is created if it doesn't
+// exist yet. items are only ever added, never rewritten, and
+// items that f no longer has are deleted, so that the cache
+// is trimmed along with the feed (see rss.MaxItems).
+func (db *DB) WriteFeedCache(f *rss.Feed) error {
+	tx, err := db.sql.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	skipHours, err := json.Marshal(f.SkipHours)
+	if err != nil {
+		return err
+	}
+	skipDays, err := json.Marshal(f.SkipDays)
+	if err != nil {
+		return err
+	}
+
+	var fid int
+	err = tx.QueryRow(`
+		INSERT INTO feed(url, title, description, link, language, author, refresh_at, ttl_seconds,
+			skip_hours, skip_days, etag, last_modified)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(url) DO UPDATE SET
+			title=excluded.title,
+			description=excluded.description,
+			link=excluded.link,
+			language=excluded.language,
+			author=excluded.author,
+			refresh_at=excluded.refresh_at,
+			ttl_seconds=excluded.ttl_seconds,
+			skip_hours=excluded.skip_hours,
+			skip_days=excluded.skip_days,
+			etag=excluded.etag,
+			last_modified=excluded.last_modified
+		RETURNING id`,
+		f.UpdateURL, f.Title, f.Description, f.Link, f.Language, f.Author,
+		f.Refresh, int64(f.TTL/time.Second), string(skipHours), string(skipDays),
+		f.ETag, f.LastModified).Scan(&fid)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO feed_item(feed_id, guid, link, data)
+		VALUES(?, ?, ?, ?)
+		ON CONFLICT(feed_id, guid) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	guids := make([]string, 0, len(f.Items))
+	for _, item := range f.Items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(fid, item.ID, item.Link, string(data))
+		if err != nil {
+			return err
+		}
+		guids = append(guids, item.ID)
+	}
+
+	kept, err := json.Marshal(guids)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM feed_item
+		WHERE feed_id = ?
+		AND guid NOT IN (SELECT value FROM json_each(?))`, fid, string(kept))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// WriteFeed writes an rss feed to the database for permanent storage
-// if the given feed already exists, WriteFeed does nothing.
-func (db *DB) GetFeedFetchError(url string) (string, error) {
-	var result sql.NullString
-	err := db.sql.QueryRow("SELECT fetch_error FROM feed WHERE url=?", url).Scan(&result)
+// GetFeedCache returns the feed at url as it was last stored by
+// WriteFeedCache. a feed that has never been cached comes back
+// as a stub with only UpdateURL & no refresh time set, so that
+// the reaper fetches it straight away.
+func (db *DB) GetFeedCache(url string) (*rss.Feed, error) {
+	var fid int
+	var ttl int64
+	var title, description, link, language, author, etag, lastModified sql.NullString
+	var refresh sql.NullTime
+	var skipHours, skipDays string
+	err := db.sql.QueryRow(`
+		SELECT id, title, description, link, language, author, refresh_at, ttl_seconds,
+			skip_hours, skip_days, etag, last_modified
+		FROM feed WHERE url=?`, url).Scan(&fid, &title, &description, &link,
+		&language, &author, &refresh, &ttl, &skipHours, &skipDays, &etag, &lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &rss.Feed{
+		UpdateURL:    url,
+		Title:        title.String,
+		Description:  description.String,
+		Link:         link.String,
+		Language:     language.String,
+		Author:       author.String,
+		Refresh:      refresh.Time,
+		TTL:          time.Duration(ttl) * time.Second,
+		ETag:         etag.String,
+		LastModified: lastModified.String,
+	}
+	err = json.Unmarshal([]byte(skipHours), &f.SkipHours)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(skipDays), &f.SkipDays)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if result.Valid {
-		return result.String, nil
+
+	rows, err := db.sql.Query("SELECT data FROM feed_item WHERE feed_id=? ORDER BY id", fid)
+	if err != nil {
+		return nil, err
 	}
-	return "", nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		item := new(rss.Item)
+		err = json.Unmarshal([]byte(data), item)
+		if err != nil {
+			return nil, err
+		}
+		f.Items = append(f.Items, item)
+	}
+	return f, rows.Err()
+}
+
+// ReapOrphanedFeeds deletes every feed that has had no
+// subscribers since before the grace period, along with its
+// cached items & fetch history, and returns their urls. feeds
+// that have just lost their last subscriber are only marked,
+// and feeds that have been subscribed to again are unmarked.
+func (db *DB) ReapOrphanedFeeds(now time.Time, grace time.Duration) ([]string, error) {
+	tx, err := db.sql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// timestamps are stored as text, so compare them in utc
+	now = now.UTC()
+	_, err = tx.Exec(`
+		UPDATE feed SET orphaned_at=NULL
+		WHERE orphaned_at IS NOT NULL
+		AND id IN (SELECT feed_id FROM subscribe)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE feed SET orphaned_at=?
+		WHERE orphaned_at IS NULL
+		AND id NOT IN (SELECT feed_id FROM subscribe)`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		DELETE FROM feed
+		WHERE orphaned_at < ?
+		AND id NOT IN (SELECT feed_id FROM subscribe)
+		RETURNING url`, now.Add(-grace))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		err = rows.Scan(&url)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return urls, tx.Commit()
 }
 
-func (db *DB) GetSubscriberCount(feedURL string) int {
+func (db *DB) GetSubscriberCount(feedURL string) (int, error) {
 	var count int
 	err := db.sql.QueryRow(`
 		SELECT COUNT(s.user_id)
@@ -305,73 +1022,181 @@ func (db *DB) GetSubscriberCount(feedURL string) int {
 		JOIN feed f ON s.feed_id = f.id
 		WHERE f.url = ?
 	`, feedURL).Scan(&count)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return count
+	return count, err
 }
 
-func (db *DB) GetFeedIDAndExists(feedURL string) (int, bool) {
+func (db *DB) GetFeedIDAndExists(feedURL string) (int, bool, error) {
 	var fid int
 	err := db.sql.QueryRow("SELECT id FROM feed WHERE url=?", feedURL).Scan(&fid)
 	if err == sql.ErrNoRows {
-		return 0, false
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
 	}
+	return fid, true, nil
+}
+
+// Subscribe subscribes the user to the feed at feedURL, which
+// must already be in the db. subscribing twice is a no-op.
+func (db *DB) Subscribe(username string, feedURL string) error {
+	res, err := db.sql.Exec(`
+		INSERT INTO subscribe (user_id, feed_id)
+		SELECT u.id, f.id FROM user u, feed f
+		WHERE u.username = ? AND f.url = ?
+		AND NOT EXISTS (
+			SELECT 1 FROM subscribe s
+			WHERE s.user_id = u.id AND s.feed_id = f.id
+		)`, username, feedURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
 	}
-	return fid, true
+
+	// nothing was inserted: either it's a repeat, or something
+	// doesn't exist
+	if _, err := db.GetUserID(username); err != nil {
+		return err
+	}
+	_, err = db.GetFeedID(feedURL)
+	return err
 }
 
+// BatchSubscribe makes the user's subscriptions exactly feedURLs.
+// only the differences are applied, so subscriptions that are
+// kept keep their created_at. it all happens in one transaction:
+// if anything fails, the old subscriptions are left untouched.
 func (db *DB) BatchSubscribe(username string, feedURLs []string) error {
 	tx, err := db.sql.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	var uid int
+	err = tx.QueryRow("SELECT id FROM user WHERE username=?", username).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user '%s': %w", username, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := subscriptions(tx, uid)
+	if err != nil {
+		return err
+	}
+	var currentURLs []string
+	for url := range current {
+		currentURLs = append(currentURLs, url)
+	}
+	added, removed := diffURLs(currentURLs, feedURLs)
 
-	defer func() {
+	for _, url := range removed {
+		_, err = tx.Exec("DELETE FROM subscribe WHERE user_id=? AND feed_id=?", uid, current[url])
+		if err != nil {
+			return err
+		}
+	}
+	for _, url := range added {
+		var fid int
+		err = tx.QueryRow("SELECT id FROM feed WHERE url=?", url).Scan(&fid)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("feed '%s': %w", url, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO subscribe (user_id, feed_id) VALUES (?, ?)", uid, fid)
 		if err != nil {
-			tx.Rollback()
+			return err
 		}
-	}()
+	}
 
-	// first, unsub from everything
-	uid := db.GetUserID(username)
-	db.unsubscribeAll(uid)
+	return tx.Commit()
+}
 
-	// Add new subscriptions
-	for _, url := range feedURLs {
-		db.subscribe(uid, db.GetFeedID(url))
+// subscriptions returns the feeds the user is subscribed to,
+// as a map of url to feed id.
+func subscriptions(tx *sql.Tx, uid int) (map[string]int, error) {
+	rows, err := tx.Query(`
+		SELECT f.url, f.id
+		FROM subscribe s
+		JOIN feed f ON s.feed_id = f.id
+		WHERE s.user_id = ?`, uid)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return tx.Commit()
+	subs := make(map[string]int)
+	for rows.Next() {
+		var url string
+		var fid int
+		err = rows.Scan(&url, &fid)
+		if err != nil {
+			return nil, err
+		}
+		subs[url] = fid
+	}
+	return subs, rows.Err()
+}
+
+// diffURLs returns the urls in next that aren't in current, in
+// the order they appear in next, and the urls in current that
+// aren't in next, sorted. duplicates are ignored.
+func diffURLs(current []string, next []string) (added []string, removed []string) {
+	have := make(map[string]bool)
+	for _, u := range current {
+		have[u] = true
+	}
+	want := make(map[string]bool)
+	for _, u := range next {
+		if !have[u] && !want[u] {
+			added = append(added, u)
+		}
+		want[u] = true
+	}
+	for u := range have {
+		if !want[u] {
+			removed = append(removed, u)
+		}
+	}
+	slices.Sort(removed)
+	return added, removed
 }
 
 func (db *DB) MarkItemRead(username string, itemURL string) error {
-	uid := db.GetUserID(username)
-	_, err := db.sql.Exec(`
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return err
+	}
+	_, err = db.sql.Exec(`
 		INSERT INTO read_item(user_id, item_url) 
 		VALUES(?, ?) 
 		ON CONFLICT(user_id, item_url) DO NOTHING`, uid, itemURL)
 	return err
 }
 
-func (db *DB) GetUserReadItems(username string) map[string]bool {
-	uid := db.GetUserID(username)
+func (db *DB) GetUserReadItems(username string) (map[string]bool, error) {
+	uid, err := db.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := db.sql.Query("SELECT item_url FROM read_item WHERE user_id = ?", uid)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	urls, err := scanStrings(rows)
+	if err != nil {
+		return nil, err
 	}
-	defer rows.Close()
 
 	readItems := make(map[string]bool)
-	for rows.Next() {
-		var itemURL string
-		err = rows.Scan(&itemURL)
-		if err != nil {
-			log.Fatal(err)
-		}
+	for _, itemURL := range urls {
 		readItems[itemURL] = true
 	}
-	return readItems
+	return readItems, nil
 }
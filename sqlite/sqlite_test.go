@@ -0,0 +1,600 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"git.j3s.sh/vore/rss"
+)
+
+func newTestDB(t *testing.T) (*DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vore.db")
+	db, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+func TestMissingUser(t *testing.T) {
+	db, _ := newTestDB(t)
+
+	_, err := db.GetUserID("nobody")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	_, err = db.GetUserFeedURLs("nobody")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = db.BatchSubscribe("nobody", nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	exists, err := db.UserExists("nobody")
+	if err != nil || exists {
+		t.Fatalf("expected no user & no error, got %v, %v", exists, err)
+	}
+}
+
+func TestQueryFailuresAreReturned(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pull the rug out from under a few queries
+	for _, table := range []string{"read_item", "subscribe", "saved_item"} {
+		_, err = db.sql.Exec("DROP TABLE " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.GetUserReadItems("reader"); err == nil {
+		t.Error("expected GetUserReadItems to fail")
+	}
+	if _, err := db.GetUserFeedURLs("reader"); err == nil {
+		t.Error("expected GetUserFeedURLs to fail")
+	}
+	if _, err := db.GetUserSavedItems("reader"); err == nil {
+		t.Error("expected GetUserSavedItems to fail")
+	}
+	if err := db.BatchSubscribe("reader", nil); err == nil {
+		t.Error("expected BatchSubscribe to fail")
+	}
+
+	// and then take the whole thing away
+	db.Close()
+	if _, err := db.UserExists("reader"); err == nil {
+		t.Error("expected UserExists to fail on a closed db")
+	}
+	if _, err := db.GetUsernameBySessionToken("token"); err == nil {
+		t.Error("expected GetUsernameBySessionToken to fail on a closed db")
+	}
+	if _, err := db.GetAllFeedURLs(); err == nil {
+		t.Error("expected GetAllFeedURLs to fail on a closed db")
+	}
+	if err := db.WriteFeed("https://example.com/feed"); err == nil {
+		t.Error("expected WriteFeed to fail on a closed db")
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	db, path := newTestDB(t)
+
+	// hold the write lock from another connection, which
+	// gives up straight away rather than waiting
+	other, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	tx, err := db.sql.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO feed(url) VALUES('https://example.com/feed')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = other.Exec("INSERT INTO feed(url) VALUES('https://example.org/feed')")
+	if !IsBusy(err) {
+		t.Fatalf("expected a busy error, got %v", err)
+	}
+	if IsBusy(errors.New("something else")) || IsBusy(nil) {
+		t.Fatal("only busy errors are busy")
+	}
+}
+
+func TestBatchSubscribe(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := "https://a.example/feed", "https://b.example/feed", "https://c.example/feed"
+	for _, u := range []string{a, b, c} {
+		err = db.WriteFeed(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectSubs := func(want ...string) {
+		t.Helper()
+		got, err := db.GetUserFeedURLs("reader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("expected subscriptions %q, got %q", want, got)
+		}
+	}
+	createdAt := func(url string) time.Time {
+		t.Helper()
+		var at time.Time
+		err := db.sql.QueryRow(`
+			SELECT s.created_at FROM subscribe s
+			JOIN feed f ON s.feed_id = f.id
+			WHERE f.url = ?`, url).Scan(&at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	err = db.BatchSubscribe("reader", []string{a, b, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSubs(a, b)
+
+	// backdate a, so that re-inserting it would be noticed
+	_, err = db.sql.Exec("UPDATE subscribe SET created_at = '2001-01-01 00:00:00'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.BatchSubscribe("reader", []string{c, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSubs(a, c)
+	if at := createdAt(a); at.Year() != 2001 {
+		t.Fatalf("expected a kept subscription to keep its created_at, got %v", at)
+	}
+	if at := createdAt(c); at.Year() == 2001 {
+		t.Fatal("expected a new subscription to get a new created_at")
+	}
+
+	// a feed that doesn't exist fails the whole batch, even
+	// though the removal of c came first
+	err = db.BatchSubscribe("reader", []string{a, "https://nope.example/feed"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	expectSubs(a, c)
+
+	err = db.BatchSubscribe("reader", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSubs()
+}
+
+func TestDiffURLs(t *testing.T) {
+	added, removed := diffURLs(
+		[]string{"b", "a", "c"},
+		[]string{"d", "a", "d", "e"},
+	)
+	if !slices.Equal(added, []string{"d", "e"}) {
+		t.Errorf("unexpected added %q", added)
+	}
+	if !slices.Equal(removed, []string{"b", "c"}) {
+		t.Errorf("unexpected removed %q", removed)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := "https://a.example/feed"
+	err = db.WriteFeed(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		err = db.Subscribe("reader", u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	subs, err := db.GetUserFeedURLs("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(subs, []string{u}) {
+		t.Fatalf("expected one subscription, got %q", subs)
+	}
+
+	if err := db.Subscribe("reader", "https://nope.example/feed"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing feed, got %v", err)
+	}
+	if err := db.Subscribe("nobody", u); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing user, got %v", err)
+	}
+}
+
+func TestSavedItemArchives(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteSavedItem("reader", SavedItem{
+		ItemTitle: "a post",
+		ItemURL:   "https://example.com/post",
+		Archives: []SavedItemArchive{
+			{Archiver: "archive.org", URL: "https://web.archive.org/web/1/https://example.com/post"},
+			{Archiver: "local", URL: "/archive/abc"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Fatalf("expected one saved item, got %d", len(saved))
+	}
+	si := saved[0]
+	if si.ArchiveURL != "https://web.archive.org/web/1/https://example.com/post" {
+		t.Errorf("expected the first archive to be the archive url, got %s", si.ArchiveURL)
+	}
+	if len(si.Archives) != 2 || si.Archives[1].Archiver != "local" || si.Archives[1].URL != "/archive/abc" {
+		t.Errorf("unexpected archives %+v", si.Archives)
+	}
+}
+
+func TestArchiveJobs(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.QueueSavedItem("reader", SavedItem{
+		ItemTitle: "a post",
+		ItemURL:   "https://example.com/post",
+	}, []string{"archive.org", "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		t.Helper()
+		saved, err := db.GetUserSavedItems("reader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved[0].ArchiveStatus + " " + saved[0].ArchiveError
+	}
+	if s := status(); s != "pending " {
+		t.Fatalf("expected a new save to be pending, got %q", s)
+	}
+
+	now := time.Now()
+	first, err := db.ClaimArchiveJob(now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.ClaimArchiveJob(now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || second == nil || first.ID == second.ID {
+		t.Fatalf("expected both jobs to be claimed once, got %+v & %+v", first, second)
+	}
+	if first.SavedItemID != id || first.ItemURL != "https://example.com/post" || first.Attempts != 1 {
+		t.Errorf("unexpected job %+v", first)
+	}
+	// claimed jobs aren't due until their lease runs out
+	job, err := db.ClaimArchiveJob(now, now.Add(time.Hour))
+	if err != nil || job != nil {
+		t.Fatalf("expected nothing to be due, got %+v, %v", job, err)
+	}
+
+	err = db.RetryArchiveJob(second.ID, now.Add(time.Minute), "slow down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "pending slow down" {
+		t.Errorf("expected a retried job to be pending, got %q", s)
+	}
+	job, err = db.ClaimArchiveJob(now.Add(2*time.Minute), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != second.ID || job.Attempts != 2 {
+		t.Fatalf("expected the retry to be claimed again, got %+v", job)
+	}
+
+	err = db.FailArchiveJob(second.ID, "gave up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "pending gave up" {
+		t.Errorf("expected the save to be pending while a job is, got %q", s)
+	}
+	err = db.FinishArchiveJob(first.ID, "https://web.archive.org/web/1/https://example.com/post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s != "done gave up" {
+		t.Errorf("expected one copy to be enough, got %q", s)
+	}
+	saved, err := db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved[0].ArchiveURL != "https://web.archive.org/web/1/https://example.com/post" || len(saved[0].Archives) != 1 {
+		t.Errorf("expected the copy to be recorded, got %+v", saved[0])
+	}
+
+	// a new archiver gets a job for every save it hasn't copied
+	n, err := db.QueueMissingArchiveJobs("archive.today", 2)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one job to be queued, got %d, %v", n, err)
+	}
+	n, err = db.QueueMissingArchiveJobs("archive.today", 2)
+	if err != nil || n != 0 {
+		t.Fatalf("expected queueing to be idempotent, got %d, %v", n, err)
+	}
+}
+
+func TestArchiveURLPreference(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.QueueSavedItem("reader", SavedItem{
+		ItemTitle: "a post",
+		ItemURL:   "https://example.com/post",
+	}, []string{"archive.org", "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := make(map[string]int)
+	now := time.Now()
+	for range 2 {
+		job, err := db.ClaimArchiveJob(now, now.Add(time.Hour))
+		if err != nil || job == nil {
+			t.Fatalf("expected a job, got %+v, %v", job, err)
+		}
+		jobs[job.Archiver] = job.ID
+	}
+
+	saved := func() SavedItem {
+		t.Helper()
+		saved, err := db.GetUserSavedItems("reader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved[0]
+	}
+	// the local copy is quicker, so it stands in until the wayback
+	// machine's is made
+	err = db.FinishArchiveJob(jobs["local"], "/archive/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si := saved(); si.ArchiveURL != "/archive/abc" {
+		t.Errorf("expected the only copy to be the archive url, got %q", si.ArchiveURL)
+	}
+	err = db.FinishArchiveJob(jobs["archive.org"], "https://web.archive.org/web/1/https://example.com/post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := saved()
+	if si.ArchiveURL != "https://web.archive.org/web/1/https://example.com/post" {
+		t.Errorf("expected the first archiver's copy to win, got %q", si.ArchiveURL)
+	}
+	if len(si.Archives) != 2 || si.Archives[0].Archiver != "archive.org" || si.Archives[1].Archiver != "local" {
+		t.Errorf("expected the copies in configured order, got %+v", si.Archives)
+	}
+}
+
+func TestSavedItemState(t *testing.T) {
+	db, _ := newTestDB(t)
+	err := db.AddUser("reader", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &rss.Item{
+		Title:      "a post",
+		Summary:    "<p>all about it</p>",
+		Categories: []string{"go", "feeds"},
+		Link:       "https://example.com/post",
+		Date:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		DateValid:  true,
+		ID:         "post-1",
+		Enclosures: []*rss.Enclosure{{URL: "https://example.com/post.mp3", Type: "audio/mpeg", Length: 1234}},
+	}
+	_, err = db.QueueSavedItem("reader", SavedItem{
+		ItemTitle: item.Title,
+		ItemURL:   item.Link,
+		Item:      item,
+		FeedURL:   "https://example.com/feed.xml",
+		FeedTitle: "example",
+		FeedLink:  "https://example.com/",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// saves from before items were kept have none of it
+	err = db.WriteSavedItem("reader", SavedItem{ItemTitle: "old", ItemURL: "https://example.com/old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := db.GetUserSavedItems("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected two saves, got %d", len(saved))
+	}
+	old, si := saved[0], saved[1]
+	if old.Item != nil || old.FeedURL != "" {
+		t.Errorf("didn't expect an old save to have a post, got %+v", old)
+	}
+	if si.FeedURL != "https://example.com/feed.xml" || si.FeedTitle != "example" || si.FeedLink != "https://example.com/" {
+		t.Errorf("unexpected feed %q %q %q", si.FeedURL, si.FeedTitle, si.FeedLink)
+	}
+	got := si.Item
+	if got == nil {
+		t.Fatal("expected the post to be kept")
+	}
+	if got.Summary != item.Summary || !got.Date.Equal(item.Date) || !got.DateValid || got.ID != item.ID ||
+		!slices.Equal(got.Categories, item.Categories) ||
+		len(got.Enclosures) != 1 || *got.Enclosures[0] != *item.Enclosures[0] {
+		t.Errorf("expected %+v, got %+v", item, got)
+	}
+}
+
+func TestManageSavedItems(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, user := range []string{"reader", "snoop"} {
+		err := db.AddUser(user, "hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := db.QueueSavedItem("reader", SavedItem{ItemTitle: "a post", ItemURL: "https://example.com/post"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := db.GetUserSavedURLs("reader")
+	if err != nil || !saved["https://example.com/post"] || len(saved) != 1 {
+		t.Fatalf("expected the post to be saved, got %v, %v", saved, err)
+	}
+
+	err = db.SetSavedItemNote("reader", id, "read this again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.GetUserSavedItems("reader")
+	if err != nil || len(items) != 1 || items[0].Note != "read this again" {
+		t.Fatalf("expected the note to be kept, got %+v, %v", items, err)
+	}
+
+	// nobody else can touch it
+	for name, err := range map[string]error{
+		"delete":  db.DeleteSavedItem("snoop", id),
+		"restore": db.RestoreSavedItem("snoop", id),
+		"note":    db.SetSavedItemNote("snoop", id, "mine now"),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound for someone else's save, got %v", name, err)
+		}
+	}
+
+	err = db.DeleteSavedItem("reader", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteSavedItem("reader", id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected deleting twice to be ErrNotFound, got %v", err)
+	}
+	items, err = db.GetUserSavedItems("reader")
+	if err != nil || len(items) != 0 {
+		t.Fatalf("expected the save to be hidden, got %+v, %v", items, err)
+	}
+	saved, err = db.GetUserSavedURLs("reader")
+	if err != nil || len(saved) != 0 {
+		t.Fatalf("expected no saved urls, got %v, %v", saved, err)
+	}
+
+	err = db.RestoreSavedItem("reader", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err = db.GetUserSavedItems("reader")
+	if err != nil || len(items) != 1 || items[0].Note != "read this again" {
+		t.Fatalf("expected the save to be back as it was, got %+v, %v", items, err)
+	}
+}
+
+func TestFeedCacheDropsTrimmedItems(t *testing.T) {
+	db, _ := newTestDB(t)
+	f := &rss.Feed{UpdateURL: "https://example.com/feed.xml"}
+	for _, id := range []string{"a", "b", "c"} {
+		f.Items = append(f.Items, &rss.Item{ID: id, Link: "https://example.com/" + id})
+	}
+	err := db.WriteFeedCache(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the feed has been trimmed & gained an item since
+	f.Items = append(f.Items[1:], &rss.Item{ID: "d", Link: "https://example.com/d"})
+	err = db.WriteFeedCache(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := db.GetFeedCache(f.UpdateURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, item := range cached.Items {
+		ids = append(ids, item.ID)
+	}
+	if !slices.Equal(ids, []string{"b", "c", "d"}) {
+		t.Errorf("expected the cache to follow the feed, got %v", ids)
+	}
+}
+
+func TestWriteFeedRescuesOrphans(t *testing.T) {
+	db, _ := newTestDB(t)
+	u := "https://a.example/feed"
+	err := db.WriteFeed(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	reaped, err := db.ReapOrphanedFeeds(now, time.Hour)
+	if err != nil || len(reaped) != 0 {
+		t.Fatalf("expected the feed to only be marked, got %q, %v", reaped, err)
+	}
+
+	// someone's about to subscribe, long after the grace period
+	err = db.WriteFeed(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reaped, err = db.ReapOrphanedFeeds(now.Add(2*time.Hour), time.Hour)
+	if err != nil || len(reaped) != 0 {
+		t.Fatalf("expected the feed to survive being written again, got %q, %v", reaped, err)
+	}
+}
@@ -1,128 +1,268 @@
+// Package wayback saves pages to the internet archive's wayback
+// machine, with its save page now api (spn2):
+// https://docs.google.com/document/d/1Nsv52MvSjbLb2PCpHlat0gkzw0EvtSgpKHu4mk0MnrA
 package wayback
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strings"
+	"time"
 )
 
-type Client struct {
-	httpClient *http.Client
-}
+const userAgent = "vore: archiver"
 
-const userAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.97 Safari/537.36"
+const (
+	defaultBaseURL         = "https://web.archive.org"
+	defaultAvailabilityURL = "https://archive.org/wayback/available"
+	defaultPollInterval    = 5 * time.Second
 
-var (
-	host = "archive.org"
-	dest = "https://web." + host
-	base = "https://web.archive.org/save/"
-
-	endpoint = "https://archive.org/wayback/available"
+	// requestTimeout bounds each request to archive.org. a whole
+	// capture, which can take minutes, is bounded by the context
+	// passed to Archive.
+	requestTimeout = 30 * time.Second
+	// latestTimeout bounds an availability check
+	latestTimeout = 10 * time.Second
+	// pollRetries is how many checks on a capture in a row can
+	// fail, other than by archive.org saying so, before it's given
+	// up on
+	pollRetries = 3
+	// maxResponseSize bounds what's read of any response
+	maxResponseSize = 1 << 20
 )
 
-// Wayback is the handle of saving webpages to archive.org
-func (wbrc *Client) Archive(ctx context.Context, u string) (result string, err error) {
-	if wbrc.httpClient == nil {
-		wbrc.httpClient = &http.Client{
-			CheckRedirect: noRedirect,
-		}
+var defaultHTTPClient = &http.Client{Timeout: requestTimeout}
+
+// ErrNotArchived is returned when the wayback machine has no
+// snapshot of a page.
+var ErrNotArchived = errors.New("wayback: no snapshot available")
+
+// Error is a capture that the wayback machine turned down or gave
+// up on.
+type Error struct {
+	// Status is archive.org's reason, like "error:not-found" or
+	// "error:too-many-daily-captures"
+	Status  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "wayback: " + e.Status
 	}
+	return fmt.Sprintf("wayback: %s: %s", e.Status, e.Message)
+}
 
-	result, err = wbrc.archive(ctx, u)
-	if err != nil {
-		return
+// Client captures pages. the zero value captures anonymously, which
+// archive.org limits more tightly than captures made with keys.
+type Client struct {
+	// AccessKey & SecretKey are archive.org's s3-style api keys,
+	// from https://archive.org/account/s3.php
+	AccessKey string
+	SecretKey string
+
+	// HTTPClient makes the requests. it defaults to one that
+	// gives up on a request after 30s.
+	HTTPClient *http.Client
+	// BaseURL defaults to https://web.archive.org, &
+	// AvailabilityURL to https://archive.org/wayback/available
+	BaseURL         string
+	AvailabilityURL string
+	// PollInterval is how often a capture is checked on while it's
+	// under way. it defaults to 5s.
+	PollInterval time.Duration
+}
+
+// status is what the spn2 api says about a capture, both when it's
+// started & when it's checked on.
+type status struct {
+	JobID       string `json:"job_id"`
+	Status      string `json:"status"`
+	StatusExt   string `json:"status_ext"`
+	Message     string `json:"message"`
+	Timestamp   string `json:"timestamp"`
+	OriginalURL string `json:"original_url"`
+}
+
+func (s status) err() *Error {
+	e := &Error{Status: s.StatusExt, Message: s.Message}
+	if e.Status == "" {
+		e.Status = "error:unknown"
 	}
-	return
+	return e
 }
 
-func (wbrc *Client) archive(ctx context.Context, uri string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+uri, nil)
+// Archive captures pageURL & waits for the capture to finish, then
+// returns the url of the snapshot. failed captures are returned as
+// an *Error.
+func (c *Client) Archive(ctx context.Context, pageURL string) (string, error) {
+	form := url.Values{"url": {pageURL}}
+	req, err := c.newRequest(ctx, http.MethodPost, c.baseURL()+"/save", strings.NewReader(form.Encode()))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("User-Agent", userAgent)
-	resp, err := wbrc.httpClient.Do(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var started status
+	err = c.do(req, &started)
 	if err != nil {
-		return "", err
+		return c.failed(ctx, pageURL, err)
 	}
-	defer resp.Body.Close()
-
-	var loc string
-	loc = resp.Header.Get("Content-Location")
-
-	if len(loc) > 0 {
-		return loc, nil
+	if started.JobID == "" {
+		return c.failed(ctx, pageURL, started.err())
 	}
 
-	loc = resp.Header.Get("Location")
-	if len(loc) > 0 {
-		return loc, nil
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
 	}
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("wayback: capture %s didn't finish: %w", started.JobID, ctx.Err())
+		case <-time.After(interval):
+		}
 
-	links := resp.Header.Get("Link")
-	re := regexp.MustCompile(`(?m)http[s]?:\/\/web\.archive\.org/web/[-a-zA-Z0-9@:%_\+.~#?&//=]*`)
-	if match := re.FindAllString(links, -1); len(match) > 0 {
-		loc = match[len(match)-1]
-		return fmt.Sprintf("%v", loc), nil
+		req, err := c.newRequest(ctx, http.MethodGet, c.baseURL()+"/save/status/"+url.PathEscape(started.JobID), nil)
+		if err != nil {
+			return "", err
+		}
+		var st status
+		err = c.do(req, &st)
+		var e *Error
+		if err != nil && !errors.As(err, &e) && ctx.Err() == nil && failures < pollRetries {
+			// the capture carries on either way, so a blip in
+			// checking on it isn't worth losing it over
+			failures++
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		failures = 0
+		switch st.Status {
+		case "pending":
+			continue
+		case "success":
+			original := st.OriginalURL
+			if original == "" {
+				original = pageURL
+			}
+			if st.Timestamp == "" {
+				// there's no telling which snapshot it made, so
+				// the newest will have to do
+				u, err := c.latest(ctx, original)
+				if err != nil {
+					return "", fmt.Errorf("wayback: capture %s finished without a timestamp: %w", started.JobID, err)
+				}
+				return u, nil
+			}
+			return c.baseURL() + "/web/" + st.Timestamp + "/" + original, nil
+		default:
+			return c.failed(ctx, pageURL, st.err())
+		}
 	}
+}
 
-	loc = resp.Request.URL.String()
-	if match := re.FindAllString(loc, -1); len(match) > 0 {
-		return fmt.Sprintf("%v", loc), nil
+// failed passes on err, unless archive.org turned the capture down
+// because it captured the page recently. that snapshot is as good
+// as a new one, so it's returned instead.
+func (c *Client) failed(ctx context.Context, pageURL string, err error) (string, error) {
+	var e *Error
+	if errors.As(err, &e) && e.Status == "error:too-many-captures" {
+		if u, lerr := c.latest(ctx, pageURL); lerr == nil {
+			return u, nil
+		}
 	}
+	return "", err
+}
+
+// latest returns the newest snapshot of pageURL, or ErrNotArchived
+// if there isn't one.
+func (c *Client) latest(ctx context.Context, pageURL string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, latestTimeout)
+	defer cancel()
 
-	loc, err = wbrc.latest(ctx, uri)
+	availabilityURL := c.AvailabilityURL
+	if availabilityURL == "" {
+		availabilityURL = defaultAvailabilityURL
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, availabilityURL+"?"+url.Values{"url": {pageURL}}.Encode(), nil)
 	if err != nil {
-		loc = base + uri
+		return "", err
 	}
-
-	// HTTP 509 Bandwidth Limit Exceeded
-	if resp.StatusCode == 509 {
-		return fmt.Sprint(loc), nil
+	var availability struct {
+		ArchivedSnapshots struct {
+			Closest *struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Status    string `json:"status"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
 	}
-
-	if resp.StatusCode != 200 {
-		return fmt.Sprint(loc), nil
+	err = c.do(req, &availability)
+	if err != nil {
+		return "", err
 	}
-
-	return loc, nil
+	closest := availability.ArchivedSnapshots.Closest
+	if closest == nil || !closest.Available || closest.Status != "200" || closest.URL == "" {
+		return "", ErrNotArchived
+	}
+	return closest.URL, nil
 }
 
-func (wbrc *Client) latest(_ context.Context, u string) (string, error) {
-	// https://web.archive.org/*/https://example.org
-	result := fmt.Sprintf("%s/*/%s", dest, u)
+func (c *Client) baseURL() string {
+	if c.BaseURL == "" {
+		return defaultBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/")
+}
 
-	uri := endpoint + "?url=" + u
-	resp, err := wbrc.httpClient.Get(uri)
+func (c *Client) newRequest(ctx context.Context, method string, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+	if c.AccessKey != "" || c.SecretKey != "" {
+		req.Header.Set("Authorization", "LOW "+c.AccessKey+":"+c.SecretKey)
+	}
+	return req, nil
+}
 
-	data, err := io.ReadAll(resp.Body)
+// do sends req & decodes its json response into v. error statuses
+// that come with an spn2 error are returned as an *Error.
+func (c *Client) do(req *http.Request, v any) error {
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	var dat map[string]interface{}
-	if err := json.Unmarshal(data, &dat); err != nil {
-		return "", err
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
 	}
 
-	if archived, ok := dat["archived_snapshots"].(map[string]interface{}); ok {
-		if closest, ok := archived["closest"].(map[string]interface{}); ok {
-			if closest["available"].(bool) && closest["status"] == "200" {
-				return closest["url"].(string), nil
-			}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var st status
+		if json.Unmarshal(body, &st) == nil && (st.StatusExt != "" || st.Message != "") {
+			return st.err()
 		}
+		return fmt.Errorf("wayback: %s %s: %s", req.Method, req.URL.Path, resp.Status)
 	}
-
-	return result, fmt.Errorf("Not found")
-}
-
-func noRedirect(req *http.Request, via []*http.Request) error {
-	return http.ErrUseLastResponse
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("wayback: %s %s: bad response: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
 }
@@ -0,0 +1,203 @@
+package wayback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeArchive stands in for archive.org. captures of /ok succeed
+// on the second check, /blocked fails, /again has been captured
+// too often already & /slow never finishes. checks on /flaky fail
+// twice before it succeeds, checks on /down always fail, & /vague
+// succeeds without saying when its snapshot is from.
+func fakeArchive(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var checks, flaky atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /save", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "LOW key:secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":"error","status_ext":"error:unauthorized","message":"bad keys"}`)
+			return
+		}
+		switch r.FormValue("url") {
+		case "https://example.com/ok":
+			fmt.Fprint(w, `{"url":"https://example.com/ok","job_id":"spn2-ok"}`)
+		case "https://example.com/blocked":
+			fmt.Fprint(w, `{"url":"https://example.com/blocked","job_id":"spn2-blocked"}`)
+		case "https://example.com/again":
+			fmt.Fprint(w, `{"status":"error","status_ext":"error:too-many-captures","message":"captured 10 times today"}`)
+		case "https://example.com/slow":
+			fmt.Fprint(w, `{"url":"https://example.com/slow","job_id":"spn2-slow"}`)
+		case "https://example.com/flaky", "https://example.com/down", "https://example.com/vague":
+			fmt.Fprintf(w, `{"url":%q,"job_id":"spn2-%s"}`, r.FormValue("url"), path.Base(r.FormValue("url")))
+		default:
+			http.Error(w, "oh no", http.StatusBadGateway)
+		}
+	})
+	mux.HandleFunc("GET /save/status/{id}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("id") {
+		case "spn2-ok":
+			if checks.Add(1) < 2 {
+				fmt.Fprint(w, `{"status":"pending","job_id":"spn2-ok"}`)
+				return
+			}
+			fmt.Fprint(w, `{"status":"success","job_id":"spn2-ok","timestamp":"20240102030405","original_url":"https://example.com/ok"}`)
+		case "spn2-blocked":
+			fmt.Fprint(w, `{"status":"error","job_id":"spn2-blocked","status_ext":"error:blocked-url","message":"this url is excluded"}`)
+		case "spn2-flaky":
+			if flaky.Add(1) <= 2 {
+				http.Error(w, "oh no", http.StatusBadGateway)
+				return
+			}
+			fmt.Fprint(w, `{"status":"success","job_id":"spn2-flaky","timestamp":"20240102030405","original_url":"https://example.com/flaky"}`)
+		case "spn2-down":
+			http.Error(w, "oh no", http.StatusBadGateway)
+		case "spn2-vague":
+			fmt.Fprint(w, `{"status":"success","job_id":"spn2-vague","original_url":"https://example.com/vague"}`)
+		default:
+			fmt.Fprint(w, `{"status":"pending"}`)
+		}
+	})
+	mux.HandleFunc("GET /available", func(w http.ResponseWriter, r *http.Request) {
+		switch u := r.FormValue("url"); u {
+		case "https://example.com/again", "https://example.com/vague":
+			fmt.Fprintf(w, `{"archived_snapshots":{"closest":{"status":"200","available":true,
+				"url":"http://web.archive.org/web/20240101000000/%s","timestamp":"20240101000000"}}}`, u)
+		default:
+			fmt.Fprint(w, `{"url":"nope","archived_snapshots":{}}`)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &checks
+}
+
+func testClient(srv *httptest.Server) *Client {
+	return &Client{
+		AccessKey:       "key",
+		SecretKey:       "secret",
+		BaseURL:         srv.URL,
+		AvailabilityURL: srv.URL + "/available",
+		PollInterval:    time.Millisecond,
+	}
+}
+
+func TestArchive(t *testing.T) {
+	srv, checks := fakeArchive(t)
+	c := testClient(srv)
+	ctx := context.Background()
+
+	got, err := c.Archive(ctx, "https://example.com/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/web/20240102030405/https://example.com/ok"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if checks.Load() != 2 {
+		t.Errorf("expected the capture to be checked on until it finished, got %d checks", checks.Load())
+	}
+
+	// a page captured too often already gets its latest snapshot
+	got, err = c.Archive(ctx, "https://example.com/again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "http://web.archive.org/web/20240101000000/https://example.com/again" {
+		t.Errorf("expected the latest snapshot, got %s", got)
+	}
+
+	// a check on the capture that goes wrong is tried again
+	got, err = c.Archive(ctx, "https://example.com/flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/web/20240102030405/https://example.com/flaky"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// a capture that doesn't say when it's from gets the latest
+	// snapshot, rather than a url with no timestamp in it
+	got, err = c.Archive(ctx, "https://example.com/vague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "http://web.archive.org/web/20240101000000/https://example.com/vague" {
+		t.Errorf("expected the latest snapshot, got %s", got)
+	}
+}
+
+func TestArchiveFailures(t *testing.T) {
+	srv, _ := fakeArchive(t)
+	c := testClient(srv)
+	ctx := context.Background()
+
+	var e *Error
+	_, err := c.Archive(ctx, "https://example.com/blocked")
+	if !errors.As(err, &e) || e.Status != "error:blocked-url" || e.Message != "this url is excluded" {
+		t.Errorf("expected a blocked-url error, got %v", err)
+	}
+
+	c.SecretKey = "wrong"
+	_, err = c.Archive(ctx, "https://example.com/ok")
+	if !errors.As(err, &e) || e.Status != "error:unauthorized" {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+	c.SecretKey = "secret"
+
+	// an error that isn't from spn2 is still an error, rather than
+	// a made up snapshot url
+	got, err := c.Archive(ctx, "https://example.com/broken")
+	if err == nil || errors.As(err, &e) {
+		t.Errorf("expected a plain error, got %q, %v", got, err)
+	}
+
+	// checks that keep going wrong are given up on
+	got, err = c.Archive(ctx, "https://example.com/down")
+	if err == nil {
+		t.Errorf("expected an error, got %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Archive(ctx, "https://example.com/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a capture that never finishes to time out, got %v", err)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	srv, _ := fakeArchive(t)
+	c := testClient(srv)
+
+	_, err := c.latest(context.Background(), "https://example.com/never")
+	if !errors.Is(err, ErrNotArchived) {
+		t.Errorf("expected ErrNotArchived, got %v", err)
+	}
+
+	// an availability check doesn't wait forever
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(hang)
+	c.AvailabilityURL = slow.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.latest(ctx, "https://example.com/again")
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the check to time out, got %v after %s", err, time.Since(start))
+	}
+}